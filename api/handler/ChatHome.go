@@ -2,14 +2,20 @@ package handler
 
 import (
 	"Gin/api/request"
+	"Gin/conf"
 	"Gin/global/model"
+	"Gin/global/pkg"
 	"Gin/inits"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"sync"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
@@ -22,21 +28,20 @@ func ChatHome(context *gin.Context) {
 	var ID int
 	// 1. 从Redis的LoginBucket中获取一个用户ID（实现ID复用机制）
 	// 1. Get a user ID from Redis's LoginBucket (implements ID reuse mechanism)
-	if id, err := model.RDB.RPop(model.Ctx, "LoginBucket").Int(); err != nil {
+	// 取出ID的同时将其连同本次连接的令牌加入当前节点的Redis集合（OnlyMark），节点崩溃时由集群清理归还
+	// The ID is added with this connection's token to the current node's Redis set (OnlyMark) in the same step, so a crashed node's IDs are returned by the cluster janitor
+	id, token, err := inits.AcquireUserID()
+	if err != nil {
 		model.Logger.Error("Connection failed: Failed to get user ID from LoginBucket", zap.Error(err))
 		return
-	} else {
-		ID = id
 	}
-	// 延迟操作：连接关闭后将ID归还到LoginBucket，确保ID可循环使用
-	// Deferred operation: Return ID to LoginBucket after connection closes to ensure ID reuse
-	defer model.RDB.LPush(model.Ctx, "LoginBucket", ID)
+	ID = id
+	// 延迟操作：连接关闭后移出节点集合、删除路由映射并将ID归还到LoginBucket，确保ID可循环使用且只归还一次；ID已转给新连接时不归还
+	// Deferred operation: After the connection closes, leave the node set, delete the route mapping and return the ID to LoginBucket exactly once; nothing is returned once the ID belongs to a new connection
+	defer inits.ReleaseUserID(ID, token)
 
-	// 2. 初始化用户连接节点（Node），用于管理WebSocket连接、数据通道和退出通知
-	// 2. Initialize user connection node (Node) to manage WebSocket connection, data channel and exit notification
-
-	// 3. 配置WebSocket升级器（将HTTP请求升级为WebSocket连接）
-	// 3. Configure WebSocket upgrader (upgrades HTTP request to WebSocket connection)
+	// 2. 配置WebSocket升级器（将HTTP请求升级为WebSocket连接）
+	// 2. Configure WebSocket upgrader (upgrades HTTP request to WebSocket connection)
 	Upgrader := websocket.Upgrader{
 		WriteBufferSize: 1024, // 写缓冲区大小 / Write buffer size
 		ReadBufferSize:  1024, // 读缓冲区大小 / Read buffer size
@@ -45,132 +50,91 @@ func ChatHome(context *gin.Context) {
 		CheckOrigin: func(r *http.Request) bool { // 新增跨域允许
 			return true
 		},
+		// 客户端可通过Sec-WebSocket-Protocol协商协议版本 / Clients may negotiate the protocol version via Sec-WebSocket-Protocol
+		Subprotocols: []string{SubprotocolV2, SubprotocolV1},
 	}
-	var Node request.Node
-	// 延迟操作：确保连接关闭、数据通道和退出通道释放，避免资源泄漏
-	// Deferred operations: Ensure connection closure and release of data/exit channels to avoid resource leaks
 	// 执行HTTP到WebSocket的连接升级
 	// Execute HTTP to WebSocket connection upgrade
-	if conn, err := Upgrader.Upgrade(context.Writer, context.Request, nil); err != nil {
+	conn, err := Upgrader.Upgrade(context.Writer, context.Request, nil)
+	if err != nil {
 		model.Logger.Error("websocket upgrade failed", zap.Error(err))
 		return
-	} else {
-		// 升级成功，初始化Node的连接和通道
-		// Upgrade successful, initialize Node's connection and channels
-		Node = request.Node{
-			Conn:     conn,              // WebSocket连接实例 / WebSocket connection instance
-			Data:     make(chan []byte), // 消息发送通道（接收待推送给用户的消息） / Message send channel (receives messages to push to user)
-			Exit:     make(chan bool),   // 连接退出通道（用于通知连接关闭） / Connection exit channel (notifies connection closure)
-			ExitFlag: &sync.Once{},
-		}
 	}
-	defer func() {
-		// 关闭WebSocket连接（此时conn非nil）
-		if err := Node.Conn.Close(); err != nil {
-			model.Logger.Warn("关闭WebSocket连接失败", zap.Error(err))
-		}
-		// 关闭数据通道
-		close(Node.Data)
-		// 关闭退出通道
-		close(Node.Exit)
-	}()
-	// 4. 将用户节点加入全局连接池，便于后续消息分发和连接管理
-	// 4. Add user node to global connection pool for subsequent message distribution and connection management
-	model.ConnectionPool[ID] = Node
-	// 延迟操作：连接关闭后从连接池移除该用户，避免无效连接残留
-	// Deferred operation: Remove user from connection pool after connection closes to avoid residual invalid connections
-	defer delete(model.ConnectionPool, ID)
+	// 升级成功，创建会话并启动其唯一的写协程；会话关闭时由写协程关闭连接
+	// Upgrade successful, create the session and start its single writer; the writer closes the connection when the session closes
+	Session := pkg.NewSession(model.Ctx, ID, conn)
+	Session.Version = NegotiateVersion(context, conn)
+	// 延迟操作：处理函数返回前确保会话已关闭，避免资源泄漏
+	// Deferred operation: Make sure the session is closed before the handler returns to avoid resource leaks
+	defer Session.Close(websocket.CloseNormalClosure, "")
 
-	// 5. 向Redis写入用户ID与节点标识（OnlyMark）的映射，用于跨节点消息路由
-	// 5. Write mapping of user ID and node identifier (OnlyMark) to Redis for cross-node message routing
+	// 3. 将用户会话加入全局会话注册表，便于后续消息分发和连接管理
+	// 3. Add user session to the global session registry for subsequent message distribution and connection management
+	model.Sessions.Add(ID, Session)
+	// 延迟操作：连接关闭后从连接池移除该用户，避免无效连接残留；同一ID已登记新会话时保留新会话
+	// Deferred operation: Remove user from connection pool after connection closes to avoid residual invalid connections; a newer session registered under the same ID is kept
+	defer model.Sessions.CompareAndRemove(ID, Session)
+
+	// 4. 向Redis写入用户ID与节点标识（OnlyMark）的映射，用于跨节点消息路由
+	// 4. Write mapping of user ID and node identifier (OnlyMark) to Redis for cross-node message routing
 	// 0表示键永不过期 / 0 means the key never expires
+	// 映射在连接关闭时由ReleaseUserID删除 / The mapping is deleted by ReleaseUserID when the connection closes
 	model.RDB.Set(model.Ctx, fmt.Sprintf("%d", ID), model.OnlyMark, 0)
-	// 延迟操作：连接关闭后删除Redis中的用户ID映射，避免脏数据
-	// Deferred operation: Delete user ID mapping in Redis after connection closes to avoid dirty data
-	defer model.RDB.Del(model.Ctx, fmt.Sprintf("%d", ID))
-
-	// 6. 将用户ID加入当前节点的Redis集合（OnlyMark），用于统计节点下在线用户
-	// 6. Add user ID to Redis set (OnlyMark) of current node for counting online users under the node
-	model.RDB.SAdd(model.Ctx, model.OnlyMark, fmt.Sprintf("%d", ID))
-	// 延迟操作：连接关闭后从Redis集合移除用户ID，确保在线状态准确
-	// Deferred operation: Remove user ID from Redis set after connection closes to ensure accurate online status
-	defer model.RDB.SRem(model.Ctx, model.OnlyMark, fmt.Sprintf("%d", ID))
 
-	// 7. 记录用户上线日志（X-Forwarded-For获取客户端真实IP，需反向代理配置支持）
-	// 7. Record user online log (X-Forwarded-For gets client's real IP, requires reverse proxy configuration support)
-	model.Logger.Info("Users go live", zap.String("Client IP", context.Request.Header.Get("X-Forwarded-For")))
-	var ll = request.InitialInformation{Id: ID}
+	// 5. 记录用户上线日志（X-Forwarded-For获取客户端真实IP，需反向代理配置支持）
+	// 5. Record user online log (X-Forwarded-For gets client's real IP, requires reverse proxy configuration support)
+	ClientIP := context.Request.Header.Get("X-Forwarded-For")
+	model.Logger.Info("Users go live", zap.String("Client IP", ClientIP))
+	var ll = request.InitialInformation{Type: model.FrameSystem, Code: model.CodeConnected, Id: ID, Version: Session.Version, Limits: request.Limits{
+		MaxFrameSize:  pkg.MaxFrameSize,
+		MaxDataLength: conf.MaxDataLength,
+		MaxViolations: conf.MaxViolations,
+	}}
 	InitialInformation, _ := json.Marshal(ll)
-	Node.Conn.WriteMessage(websocket.TextMessage, InitialInformation)
-	// 8. 使用WaitGroup等待读写协程完成，确保连接关闭前读写操作正常收尾
-	// 8. Use WaitGroup to wait for read/write goroutines to complete, ensuring proper cleanup of read/write operations before connection closes
-	go ChatWrite(Node, context.Request.Header.Get("X-Forwarded-For"))
-	// 启动消息读取协程（接收客户端发送的消息）
-	// Start message read goroutine (receives messages from client)
-	go CharRead(Node, context.Request.Header.Get("X-Forwarded-For"), ID)
-	var WG sync.WaitGroup
-	WG.Add(1) // 注册1个待等待的协程（退出监听） / Register 1 goroutines to wait for (exit goroutine)
-	go CharExit(&WG, Node)
-	WG.Wait() // 阻塞等待读写协程结束 / Block and wait for read/write goroutines to end
-	return
-}
-
-func CharExit(s *sync.WaitGroup, node request.Node) {
-	for {
-		ok := <-node.Exit
-		if ok {
-			s.Done()
-			return
-		}
-	}
-}
-
-// ChatWrite 消息读取协程：从客户端接收消息并推送到数据通道
-// ChatWrite message read goroutine: Receives messages from client and pushes to data channel
-func ChatWrite(node request.Node, clientIP string) {
-	for { // 改为无限循环，同时监听两个通道
-		// 正常接收消息并发送
-		data, ok := <-node.Data
-		// 检查 data 通道是否已关闭（避免永久阻塞）
-		if !ok {
-			model.Logger.Info(fmt.Sprintf("User data channel closed: %s", clientIP))
-			node.ExitFlag.Do(
-				func() {
-					node.Exit <- true
-				},
-			)
-			return
-		}
-		// 发送消息
-		if err := node.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
-			model.Logger.Error("Failed to write message", zap.String("Client IP", clientIP), zap.Error(err))
-			node.ExitFlag.Do(
-				func() {
-					node.Exit <- true
-				},
-			)
-			return
-		}
-
+	Session.Send(InitialInformation)
+	// 6. 启动消息读取协程（接收客户端发送的消息），并等待会话关闭
+	// 6. Start message read goroutine (receives messages from client) and wait for the session to close
+	go CharRead(Session, ClientIP, ID)
+	<-Session.Done()
+	if err := Session.Err(); err != nil {
+		model.Logger.Error("Failed to write message", zap.String("Client IP", ClientIP), zap.Error(err))
 	}
+	model.Logger.Info(fmt.Sprintf("User session closed: %s", ClientIP))
 }
 
 // CharRead 消息写入协程：从客户端读取消息并处理
 // CharRead message write goroutine: Reads messages from client and processes them
-func CharRead(node request.Node, Name string, ID int) {
+func CharRead(node *pkg.Session, Name string, ID int) {
+	// violations 该连接已发送的非法消息条数 / violations counts the invalid messages sent on this connection
+	violations := 0
+	// reject 告知客户端消息非法，超过允许的条数时以1008关闭连接，返回连接是否已关闭
+	// reject tells the client its message is invalid and closes the connection with 1008 once too many were sent, reporting whether it closed
+	reject := func(code string, message string, target int, replyTo string) bool {
+		violations++
+		if violations > conf.MaxViolations {
+			model.Logger.Warn("Too many invalid messages, closing connection", zap.String("Client IP", Name), zap.Int("violations", violations))
+			node.Close(websocket.ClosePolicyViolation, "too many invalid messages")
+			return true
+		}
+		SendError(node, code, message, target, replyTo)
+		return false
+	}
 	for {
 		// 从WebSocket连接读取消息（忽略消息类型，仅关注消息内容）
 		// Read message from WebSocket connection (ignore message type, only focus on content)
-		_, message, err := node.Conn.ReadMessage()
+		_, message, err := node.ReadMessage()
 		if err != nil {
-			model.Logger.Error("read message failed", zap.String("Client IP", Name), zap.Error(err))
-			// 读取消息失败，发送退出信号并终止协程
-			// Failed to read message, send exit signal and terminate goroutine
-			node.ExitFlag.Do(
-				func() {
-					node.Exit <- true
-				},
-			)
+			// 会话已在关闭时读取失败属于正常现象 / A read failure on a closing session is expected
+			if node.State() == pkg.SessionOpen {
+				model.Logger.Error("read message failed", zap.String("Client IP", Name), zap.Error(err))
+			}
+			// 读取消息失败，关闭会话并终止协程；帧超过大小限制时以1009关闭
+			// Failed to read message, close the session and terminate goroutine; frames over the size limit close with 1009
+			if errors.Is(err, websocket.ErrReadLimit) {
+				node.Close(websocket.CloseMessageTooBig, "frame too large")
+			} else {
+				node.Close(websocket.CloseNormalClosure, "")
+			}
 			return
 		}
 
@@ -181,78 +145,262 @@ func CharRead(node request.Node, Name string, ID int) {
 			model.Logger.Error("unmarshal message failed", zap.String("Client IP", Name), zap.Error(err))
 			// 反序列化失败，向客户端返回错误提示
 			// Deserialization failed, return error prompt to client
-			node.Data <- []byte("Message resolution failed")
+			if reject(model.CodeInvalidMessage, "message is not valid JSON", 0, "") {
+				return
+			}
+			continue
+		}
+		// 路由前校验类型、目标和内容长度，避免非法消息扩散到整个集群
+		// Validate type, target and content length before routing so invalid messages never spread across the cluster
+		if code, reason := ValidateMessage(Message); code != "" {
+			model.Logger.Warn("Invalid message", zap.String("Client IP", Name), zap.String("code", code))
+			if reject(code, reason, Message.Target, Message.ClientId) {
+				return
+			}
+			continue
+		}
+		// 接收方确认收到消息：校验确认方确实是该消息的接收方后，将DELIVERED状态送回原消息发送方，不回显也不计入消息
+		// The recipient acknowledges a message: once the acknowledging user is verified as its recipient, route a DELIVERED status back to the original sender, without echoing or counting it as a message
+		if Message.Type == "ack" {
+			if err := inits.AckMessage(Message.Id, ID); errors.Is(err, inits.ErrAckRejected) {
+				SendError(node, model.CodeInvalidAck, "message is unknown, expired, already acknowledged or not addressed to you", 0, Message.ClientId)
+			} else if err != nil {
+				model.Logger.Error("Acknowledge message failed", zap.String("id", Message.Id), zap.Error(err))
+				SendError(node, model.CodeInternalError, "acknowledgement could not be processed", 0, Message.ClientId)
+			}
 			continue
 		}
 		model.Logger.Info("user seed data ok")
 		// 2. 构造消息响应体（添加发送方ID，用于接收方识别来源）
 		// 2. Construct message response body (add sender ID for receiver to identify source)
+		// 无论发送方使用哪个版本，都分配消息ID和服务端时间戳，接收方按自己的版本收取
+		// The message ID and server timestamp are assigned whatever the sender's version, each recipient gets the shape of its own version
 		var Response = model.Response{
-			Data:   Message.Data,   // 消息内容 / Message content
-			Target: Message.Target, // 消息目标（群ID或单个用户ID） / Message target (group ID or single user ID)
-			Type:   Message.Type,   // 消息类型（group：群聊；once：单聊） / Message type (group: group chat; once: private chat)
-			FormId: ID,             // 发送方用户ID / Sender user ID
+			Data:        Message.Data,           // 消息内容 / Message content
+			Target:      Message.Target,         // 消息目标（群ID或单个用户ID） / Message target (group ID or single user ID)
+			Type:        Message.Type,           // 消息类型（group：群聊；once：单聊） / Message type (group: group chat; once: private chat)
+			FormId:      ID,                     // 发送方用户ID / Sender user ID
+			Id:          uuid.NewString(),       // 服务端消息ID / Server message ID
+			Time:        time.Now().UnixMilli(), // 服务端时间戳 / Server timestamp
+			ClientId:    Message.ClientId,       // 客户端消息ID / Client message ID
+			ContentType: Message.ContentType,    // 内容类型 / Content type
+			Metadata:    Message.Metadata,       // 自定义元数据 / Free-form metadata
 		}
 
-		// 3. 序列化响应体（转为JSON字节流，便于RabbitMQ传输）
-		// 3. Serialize response body (convert to JSON byte stream for RabbitMQ transmission)
+		// 3. 序列化响应体（转为JSON字节流，便于RabbitMQ传输）；节点之间始终传递完整字段
+		// 3. Serialize response body (convert to JSON byte stream for RabbitMQ transmission); nodes always exchange every field
 		data, err := json.Marshal(Response)
 		if err != nil {
 			model.Logger.Error("Data serialization failed", zap.String("Client IP", Name), zap.Error(err))
 			// 序列化失败，向客户端返回错误提示
 			// Serialization failed, return error prompt to client
-			node.Data <- []byte("Message push failed")
+			SendError(node, model.CodeInternalError, "message could not be serialized", Message.Target, Message.ClientId)
 			continue
 		}
 		// 4. 根据消息类型分发消息（通过RabbitMQ实现跨节点消息路由）
 		// 4. Distribute messages by message type (achieve cross-node message routing via RabbitMQ)
 		switch Message.Type {
 		case "group":
-			// 群聊消息：获取所有节点标识，向每个节点的RabbitMQ队列发送消息
-			// Group chat message: Get all node identifiers, send message to each node's RabbitMQ queue
-			OtherOnlyMarks := model.RDB.HGetAll(model.Ctx, "Nodes").Val()
-			for mark, _ := range OtherOnlyMarks {
-				// 检查当前节点的RabbitMQ连接是否存在，不存在则重新同步连接
-				// Check if RabbitMQ connection for current node exists; resync if not
-				_, ok := model.RabbieMqPoll[mark]
-				if !ok {
-					inits.PullAndConnRabbieMq()
+			// 配置了集群广播时只发布一次，由各节点订阅接收
+			// With a cluster broadcast configured, publish once and let every node receive it through its subscription
+			if model.Fanout != nil {
+				if err := model.Fanout.Broadcast(data); err != nil {
+					model.Logger.Error("Broadcast group message failed", zap.Error(err))
+					SendFailed(node, model.CodePublishFailed, "group message could not be broadcast", Response)
+					continue
 				}
-				// 向该节点的RabbitMQ队列发布群聊消息
-				// Publish group chat message to the node's RabbitMQ queue
-				model.RabbieMqPoll[mark].PublishSimple(string(data))
+				inits.SendStatus(node, inits.StatusOf(Response, model.StatusSent))
+				continue
+			}
+			// 群聊消息：获取所有存活节点标识，向每个节点投递消息
+			// Group chat message: Get all live node identifiers, deliver message to each node
+			OtherOnlyMarks, err := inits.LiveNodes()
+			if err != nil {
+				// 无法读取节点列表时不能当作没有节点而报告已发送
+				// Without the node list the message must not be reported as sent to zero nodes
+				model.Logger.Error("Get live nodes failed", zap.Error(err))
+				SendFailed(node, model.CodePublishFailed, "group message could not be delivered", Response)
+				continue
+			}
+			failed := 0
+			for _, mark := range OtherOnlyMarks {
+				if err := inits.PublishToNode(mark, data); err != nil {
+					model.Logger.Error("Publish group message failed", zap.String("node", mark), zap.Error(err))
+					failed++
+				}
+			}
+			if failed > 0 {
+				SendFailed(node, model.CodePublishFailed, fmt.Sprintf("group message could not be delivered to %d of %d nodes", failed, len(OtherOnlyMarks)), Response)
+				continue
 			}
+			inits.SendStatus(node, inits.StatusOf(Response, model.StatusSent))
 
 		case "once":
-			// 单聊消息：根据目标用户ID获取其所在节点标识，向对应节点的RabbitMQ队列发送消息
-			// Private chat message: Get target user's node identifier by user ID, send message to the node's RabbitMQ queue
+			// 记录发送方和接收方，只有真正的接收方才能确认该消息
+			// Record the sender and recipient so only the real recipient can acknowledge the message
+			if err := inits.RecordMessage(Response); err != nil {
+				model.Logger.Error("Record message failed", zap.String("id", Response.Id), zap.Error(err))
+			}
+			// 目标用户就在本节点时直接放入其发送队列，不经过Redis和消息代理
+			// When the target user is on this node, put the message straight on its send queue, bypassing Redis and the broker
+			if DeliverLocal(Message.Target, Response) {
+				inits.SendResponse(node, Response)
+				inits.SendStatus(node, inits.StatusOf(Response, model.StatusSent))
+				continue
+			}
+			// 单聊消息：根据目标用户ID获取其所在节点标识，向对应节点投递消息
+			// Private chat message: Get target user's node identifier by user ID, deliver message to that node
 			OtherOnlyMark, RedisOk := model.RDB.Get(model.Ctx, fmt.Sprintf("%d", Message.Target)).Result()
 			if RedisOk != nil {
-				var res = model.Response{
-					Data:   "当前用户不在线",
-					Target: ID,
-					Type:   "once",
-					FormId: -1,
-				}
-				data, _ := json.Marshal(res)
-				node.Conn.WriteMessage(websocket.TextMessage, data)
+				inits.SettleDiverted(Response.Id)
+				SendFailed(node, model.CodeUserOffline, "target user is offline", Response)
+				continue
+			}
+			if err := inits.PublishToNode(OtherOnlyMark, data); err != nil {
+				// 消息未能交给消息代理，告知发送方而不是回显消息
+				// The message could not be handed to the broker, tell the sender instead of echoing it
+				model.Logger.Error("Publish private message failed", zap.String("node", OtherOnlyMark), zap.Error(err))
+				inits.SettleDiverted(Response.Id)
+				SendFailed(node, model.CodePublishFailed, "message could not be delivered", Response)
 				continue
 			}
-			// 检查目标节点的RabbitMQ连接是否存在，不存在则重新同步连接
-			// Check if RabbitMQ connection for target node exists; resync if not
-			_, ok := model.RabbieMqPoll[OtherOnlyMark]
-			if !ok {
-				inits.PullAndConnRabbieMq()
+			// 目标已不在本节点时，后续本地消息不会再与之竞争
+			// Once the target is on another node, later local messages cannot race with it
+			if OtherOnlyMark != model.OnlyMark {
+				inits.SettleDiverted(Response.Id)
+			}
+			// 目标在本节点、只是本地直投失败而改走消息代理的消息单独计数，不算作跨节点投递
+			// Messages whose target is on this node but that fell back to the broker after a failed local delivery are counted apart from cross-node deliveries
+			if OtherOnlyMark == model.OnlyMark {
+				deliveryMetrics.Diverted.Add(1)
+			} else {
+				deliveryMetrics.Remote.Add(1)
 			}
-			// 向目标节点的RabbitMQ队列发布单聊消息
-			// Publish private chat message to the target node's RabbitMQ queue
-			model.RabbieMqPoll[OtherOnlyMark].PublishSimple(string(data))
-			node.Conn.WriteMessage(websocket.TextMessage, data)
+			inits.SendResponse(node, Response)
+			inits.SendStatus(node, inits.StatusOf(Response, model.StatusSent))
 		default:
 			// 非法消息类型：记录错误日志并向客户端返回提示
 			// Illegal message type: Record error log and return prompt to client
 			model.Logger.Error("Illegal message type", zap.String("Client IP", Name), zap.String("Message Type", Message.Type))
-			node.Data <- []byte("Illegal import the type")
+			SendError(node, model.CodeInvalidType, "type must be group, once or ack", Message.Target, Message.ClientId)
 		}
 	}
 }
+
+// ValidateMessage 校验客户端消息，合法时返回空错误码
+// ValidateMessage validates a client message, returning an empty code when it is valid
+func ValidateMessage(Message model.Message) (code string, reason string) {
+	switch Message.Type {
+	case "group":
+		if Message.Target < 0 {
+			return model.CodeInvalidTarget, "group target must not be negative"
+		}
+	case "once":
+		if Message.Target < 1 || Message.Target > inits.LoginBucketSize {
+			return model.CodeInvalidTarget, fmt.Sprintf("target must be a user ID between 1 and %d", inits.LoginBucketSize)
+		}
+	case "ack":
+		// 发送方取自服务端的投递记录，确认消息只需携带消息ID
+		// The sender comes from the server's delivery record, an ack only carries the message ID
+		if Message.Id == "" || len(Message.Id) > MaxMessageIdLength {
+			return model.CodeInvalidMessage, fmt.Sprintf("ack must carry a message Id of at most %d bytes", MaxMessageIdLength)
+		}
+	default:
+		return model.CodeInvalidType, "type must be group, once or ack"
+	}
+	if len(Message.Data) > conf.MaxDataLength {
+		return model.CodeDataTooLong, fmt.Sprintf("data must not exceed %d bytes", conf.MaxDataLength)
+	}
+	if len(Message.ContentType) > MaxContentTypeLength {
+		return model.CodeInvalidMessage, fmt.Sprintf("content type must not exceed %d bytes", MaxContentTypeLength)
+	}
+	size := 0
+	for key, value := range Message.Metadata {
+		size += len(key) + len(value)
+	}
+	if size > conf.MaxDataLength {
+		return model.CodeDataTooLong, fmt.Sprintf("metadata must not exceed %d bytes", conf.MaxDataLength)
+	}
+	return "", ""
+}
+
+// MaxContentTypeLength 内容类型的最大长度
+// MaxContentTypeLength is the maximum length of a content type
+const MaxContentTypeLength = 64
+
+// MaxMessageIdLength ack消息中消息ID的最大长度
+// MaxMessageIdLength is the maximum length of the message ID in an ack message
+const MaxMessageIdLength = 64
+
+const (
+	// SubprotocolV1 v1协议对应的WebSocket子协议 / SubprotocolV1 is the WebSocket subprotocol for protocol v1
+	SubprotocolV1 = "chat.v1"
+	// SubprotocolV2 v2协议对应的WebSocket子协议 / SubprotocolV2 is the WebSocket subprotocol for protocol v2
+	SubprotocolV2 = "chat.v2"
+)
+
+// NegotiateVersion 确定连接使用的协议版本：协商出chat.v2子协议或查询参数version=2时为v2，否则为v1
+// NegotiateVersion decides the connection's protocol version: v2 when the chat.v2 subprotocol was negotiated or the query has version=2, v1 otherwise
+func NegotiateVersion(context *gin.Context, conn *websocket.Conn) int {
+	switch conn.Subprotocol() {
+	case SubprotocolV2:
+		return model.ProtocolV2
+	case SubprotocolV1:
+		return model.ProtocolV1
+	}
+	if context.Query("version") == strconv.Itoa(model.ProtocolV2) {
+		return model.ProtocolV2
+	}
+	return model.ProtocolV1
+}
+
+// deliveryMetrics 单聊消息的本地直投、发往其他节点以及目标在本节点但改走消息代理的累计次数
+// deliveryMetrics counts private messages delivered locally, sent to other nodes, and diverted to the broker while their target is on this node
+var deliveryMetrics struct {
+	Local    atomic.Int64
+	Remote   atomic.Int64
+	Diverted atomic.Int64
+}
+
+// DeliverLocal 目标会话在本节点时直接投递，返回是否已投递；发送队列已满或会话正在关闭时返回false，
+// 由调用方改走消息代理，从而与跨节点消息一样经历重试和死信流程。改道的消息处理完之前，发往同一目标的后续消息也走消息代理，保证顺序
+// DeliverLocal delivers straight to the target session when it is on this node and reports whether it did;
+// it returns false when the send queue is full or the session is closing, so the caller falls back to the broker and the message gets the same retry and dead-letter handling as a cross-node one.
+// Until the diverted message is settled, later messages to the same target take the broker as well, keeping their order
+func DeliverLocal(target int, Response model.Response) bool {
+	session, ok := model.Sessions.Get(target)
+	if !ok {
+		return false
+	}
+	if !inits.Diverted(target) && inits.SendResponse(session, Response) == nil {
+		deliveryMetrics.Local.Add(1)
+		return true
+	}
+	inits.Divert(Response)
+	return false
+}
+
+// SendError 向客户端发送错误帧，replyTo为相关客户端消息的ClientId；v2连接额外带上服务端时间戳和协议版本
+// SendError sends an error frame to the client, replyTo is the ClientId of the related client message; v2 connections also get the server timestamp and protocol version
+func SendError(node *pkg.Session, code string, message string, target int, replyTo string) {
+	frame := model.SystemResponse{
+		Type:    model.FrameError,
+		Code:    code,
+		Message: message,
+		Target:  target,
+		ReplyTo: replyTo,
+	}
+	if node.Version >= model.ProtocolV2 {
+		frame.Time = time.Now().UnixMilli()
+		frame.Version = model.ProtocolV2
+	}
+	data, _ := json.Marshal(frame)
+	node.Send(data)
+}
+
+// SendFailed 已分配消息ID的消息无法投递时，发送错误帧并向v2连接发送FAILED状态帧
+// SendFailed sends an error frame and, on v2 connections, a FAILED status frame when a message that already has an ID cannot be delivered
+func SendFailed(node *pkg.Session, code string, message string, Response model.Response) {
+	SendError(node, code, message, Response.Target, Response.ClientId)
+	inits.SendStatus(node, inits.StatusOf(Response, model.StatusFailed))
+}
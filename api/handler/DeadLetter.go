@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"Gin/global/model"
+	"Gin/global/pkg"
+	"Gin/inits"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// deadLetterScanLimit 重放时查找死信的最大条数
+// deadLetterScanLimit is the maximum number of dead letters scanned when replaying
+const deadLetterScanLimit = 1000
+
+// ErrUserOffline 目标用户不在线
+// ErrUserOffline means the target user is offline
+var ErrUserOffline = errors.New("target user offline")
+
+// deadLetterStore 获取当前消息代理的死信管理能力，不支持时向客户端返回501
+// deadLetterStore gets the dead-letter management of the current broker, answering 501 when unsupported
+func deadLetterStore(context *gin.Context) (pkg.DeadLetterStore, bool) {
+	store, ok := model.Broker.(pkg.DeadLetterStore)
+	if !ok {
+		context.JSON(http.StatusNotImplemented, gin.H{"message": "broker does not support dead letters"})
+	}
+	return store, ok
+}
+
+// ListDeadLetters 查看死信队列（不会移除消息），limit默认50
+// ListDeadLetters lists the dead-letter queue (without removing messages), limit defaults to 50
+func ListDeadLetters(context *gin.Context) {
+	store, ok := deadLetterStore(context)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(context.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > deadLetterScanLimit {
+		context.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("limit must be between 1 and %d", deadLetterScanLimit)})
+		return
+	}
+	letters, err := store.DeadLetters(limit)
+	if err != nil {
+		model.Logger.Error("List dead letters failed", zap.Error(err))
+		context.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "ok", "data": letters})
+}
+
+// ReplayDeadLetter 重新路由指定死信，投递成功后将其从死信队列删除
+// ReplayDeadLetter reroutes the given dead letter and removes it from the dead-letter queue once delivered
+func ReplayDeadLetter(context *gin.Context) {
+	store, ok := deadLetterStore(context)
+	if !ok {
+		return
+	}
+	id := context.Param("id")
+	letters, err := store.DeadLetters(deadLetterScanLimit)
+	if err != nil {
+		model.Logger.Error("List dead letters failed", zap.Error(err))
+		context.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	for _, letter := range letters {
+		if letter.ID != id {
+			continue
+		}
+		// 目标用户仍不在线时保留死信，返回409
+		// Keep the dead letter and answer 409 while the target user is still offline
+		if err := Redeliver([]byte(letter.Body)); err != nil {
+			context.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+			return
+		}
+		if err := store.RemoveDeadLetter(id); err != nil {
+			model.Logger.Error("Remove replayed dead letter failed", zap.String("id", id), zap.Error(err))
+		}
+		context.JSON(http.StatusOK, gin.H{"message": "ok"})
+		return
+	}
+	context.JSON(http.StatusNotFound, gin.H{"message": pkg.ErrDeadLetterNotFound.Error()})
+}
+
+// PurgeDeadLetters 清空死信队列
+// PurgeDeadLetters empties the dead-letter queue
+func PurgeDeadLetters(context *gin.Context) {
+	store, ok := deadLetterStore(context)
+	if !ok {
+		return
+	}
+	count, err := store.PurgeDeadLetters()
+	if err != nil {
+		model.Logger.Error("Purge dead letters failed", zap.Error(err))
+		context.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	model.Logger.Info("Dead letters purged", zap.Int("count", count))
+	context.JSON(http.StatusOK, gin.H{"message": "ok", "data": count})
+}
+
+// Redeliver 按目标用户当前所在节点重新投递一条单聊消息
+// Redeliver delivers a private message again to the node its target user is currently on
+func Redeliver(data []byte) error {
+	var Response model.Response
+	if err := json.Unmarshal(data, &Response); err != nil {
+		return err
+	}
+	if Response.Type != "once" {
+		return fmt.Errorf("message type %q cannot be replayed", Response.Type)
+	}
+	mark, err := model.RDB.Get(model.Ctx, fmt.Sprintf("%d", Response.Target)).Result()
+	if err != nil {
+		return ErrUserOffline
+	}
+	return inits.PublishToNode(mark, data)
+}
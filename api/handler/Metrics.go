@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"Gin/global/model"
+	"Gin/global/pkg"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics 查看当前节点的累计计数
+// Metrics shows the cumulative counters of the current node
+func Metrics(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{"message": "ok", "data": gin.H{
+		"node":                model.OnlyMark,
+		"sessions":            model.Sessions.Len(),
+		"dropped":             pkg.SessionMetrics.Dropped.Load(),
+		"slow_disconnects":    pkg.SessionMetrics.SlowDisconnects.Load(),
+		"idle_timeouts":       pkg.SessionMetrics.IdleTimeouts.Load(),
+		"local_deliveries":    deliveryMetrics.Local.Load(),
+		"remote_deliveries":   deliveryMetrics.Remote.Load(),
+		"diverted_deliveries": deliveryMetrics.Diverted.Load(),
+	}})
+}
@@ -0,0 +1,22 @@
+package handler
+
+import (
+	"Gin/global/model"
+	"Gin/inits"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ListNodes 查看所有存活节点的元数据（公布地址、版本、启动时间、连接数）
+// ListNodes lists the metadata of every live node (advertised address, version, start time, connection count)
+func ListNodes(context *gin.Context) {
+	infos, err := inits.LiveNodeInfos()
+	if err != nil {
+		model.Logger.Error("List nodes failed", zap.Error(err))
+		context.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"message": "ok", "data": infos})
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"Gin/conf"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminMiddleware 管理接口鉴权中间件，要求请求头 X-Admin-Token 与配置的 ADMIN_TOKEN 一致
+// AdminMiddleware authenticates admin API requests, the X-Admin-Token header must match the configured ADMIN_TOKEN
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 1. 未配置令牌时管理接口整体关闭
+		// 1. The admin API is disabled entirely when no token is configured
+		if conf.AdminToken == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "admin api disabled"})
+			return
+		}
+
+		// 2. 常量时间比较令牌，避免时序攻击
+		// 2. Compare tokens in constant time to avoid timing attacks
+		token := c.GetHeader("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(conf.AdminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "invalid admin token"})
+			return
+		}
+
+		// 3. 继续执行后续处理器
+		// 3. Proceed to the next handler
+		c.Next()
+	}
+}
@@ -1,19 +1,19 @@
 package request
 
-import (
-	"sync"
-
-	"github.com/gorilla/websocket"
-)
-
-// Node 用户连接节点结构体，用于管理单个用户的WebSocket连接及相关通信通道
-// Node struct for user connection, managing a single user's WebSocket connection and related communication channels
-type Node struct {
-	Conn     *websocket.Conn // WebSocket连接实例 / WebSocket connection instance
-	Data     chan []byte     // 数据通道，用于接收待发送给用户的消息 / Data channel for receiving messages to be sent to the user
-	Exit     chan bool       // 退出通道，用于通知关闭连接 / Exit channel for notifying connection closure
-	ExitFlag *sync.Once
-}
+// InitialInformation 连接建立后发送给用户的初始信息（系统帧）
+// InitialInformation is the initial information sent to the user once connected (a system frame)
 type InitialInformation struct {
-	Id int
+	Type    string // 固定为system / Always system
+	Code    string // 固定为CONNECTED / Always CONNECTED
+	Id      int
+	Version int // 本连接协商的协议版本 / Protocol version negotiated on this connection
+	Limits  Limits
+}
+
+// Limits 服务端对客户端消息的限制，随初始信息告知客户端
+// Limits are the server's limits on client messages, announced in the initial information
+type Limits struct {
+	MaxFrameSize  int64 // 单帧最大字节数 / Maximum frame size in bytes
+	MaxDataLength int   // Data字段最大字节数 / Maximum Data size in bytes
+	MaxViolations int   // 允许的非法消息条数 / Number of invalid messages tolerated
 }
@@ -21,4 +21,22 @@ func Run(r *gin.Engine) {
 	// 注册聊天首页接口
 	// Register chat home page interface
 	Origin.GET("/chat_home", handler.ChatHome)
+
+	// 创建管理接口路由组，需携带管理令牌
+	// Create the admin route group, requests must carry the admin token
+	Admin := r.Group("/admin", middleware.AdminMiddleware())
+
+	// 注册死信队列管理接口：查看、重放、清空
+	// Register dead-letter queue admin interfaces: list, replay, purge
+	Admin.GET("/dead_letters", handler.ListDeadLetters)
+	Admin.POST("/dead_letters/:id/replay", handler.ReplayDeadLetter)
+	Admin.DELETE("/dead_letters", handler.PurgeDeadLetters)
+
+	// 注册节点查看接口
+	// Register the node listing interface
+	Admin.GET("/nodes", handler.ListNodes)
+
+	// 注册当前节点计数查看接口
+	// Register the current node's metrics interface
+	Admin.GET("/metrics", handler.Metrics)
 }
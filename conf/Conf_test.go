@@ -0,0 +1,30 @@
+package conf
+
+import (
+	"testing"
+	"time"
+)
+
+// TestReadDeliveryRetriesDefaults 未设置任何重试环境变量时，重试次数和等待时间都取默认值
+// TestReadDeliveryRetriesDefaults checks that the retry limit and waits all take their defaults when no retry env var is set
+func TestReadDeliveryRetriesDefaults(t *testing.T) {
+	t.Setenv("DELIVERY_RETRIES", "")
+	t.Setenv("DELIVERY_RETRY_BACKOFF", "")
+	t.Setenv("DELIVERY_RETRY_MAX_BACKOFF", "")
+	ReadDeliveryRetries()
+	if DeliveryRetries != 3 || DeliveryRetryBackoff != 200*time.Millisecond || DeliveryRetryMaxBackoff != 5*time.Second {
+		t.Fatalf("retries=%d backoff=%s max=%s, want 3, 200ms and 5s", DeliveryRetries, DeliveryRetryBackoff, DeliveryRetryMaxBackoff)
+	}
+}
+
+// TestReadDeliveryRetriesOverrides 设置的环境变量覆盖默认值
+// TestReadDeliveryRetriesOverrides checks that the env vars override the defaults
+func TestReadDeliveryRetriesOverrides(t *testing.T) {
+	t.Setenv("DELIVERY_RETRIES", "5")
+	t.Setenv("DELIVERY_RETRY_BACKOFF", "50ms")
+	t.Setenv("DELIVERY_RETRY_MAX_BACKOFF", "1s")
+	ReadDeliveryRetries()
+	if DeliveryRetries != 5 || DeliveryRetryBackoff != 50*time.Millisecond || DeliveryRetryMaxBackoff != time.Second {
+		t.Fatalf("retries=%d backoff=%s max=%s, want 5, 50ms and 1s", DeliveryRetries, DeliveryRetryBackoff, DeliveryRetryMaxBackoff)
+	}
+}
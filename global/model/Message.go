@@ -4,4 +4,13 @@ type Message struct {
 	Type   string `json:"Type"`
 	Data   string `json:"Data"`
 	Target int    `json:"Target"`
+	// ClientId 客户端自定义的消息标识（可选），服务端的系统帧和错误帧通过ReplyTo回传
+	// ClientId is an optional client-chosen message identifier, echoed back as ReplyTo in system and error frames
+	ClientId string `json:"ClientId"`
+	// ContentType 内容类型（v2，可选） / ContentType is the content type (v2, optional)
+	ContentType string `json:"ContentType"`
+	// Metadata 自定义元数据（v2，可选） / Metadata is free-form metadata (v2, optional)
+	Metadata map[string]string `json:"Metadata"`
+	// Id ack消息确认的服务端消息ID（v2） / Id is the server message ID acknowledged by an ack message (v2)
+	Id string `json:"Id"`
 }
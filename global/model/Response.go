@@ -1,8 +1,109 @@
 package model
 
+import "encoding/json"
+
+// ProtocolV1 初始协议：消息只包含Data、Target、Type、FormId
+// ProtocolV1 is the original protocol: messages carry only Data, Target, Type and FormId
+const ProtocolV1 = 1
+
+// ProtocolV2 v2协议：在v1基础上增加消息ID、服务端时间戳、客户端消息ID、内容类型、元数据和协议版本
+// ProtocolV2 adds the message ID, server timestamp, client message ID, content type, metadata and protocol version on top of v1
+const ProtocolV2 = 2
+
+// Response 聊天消息；节点之间始终传递完整字段，发给客户端时按连接协商的版本编码
+// Response is a chat message; nodes always exchange every field and encode it for the client with the version negotiated on its connection
 type Response struct {
 	Data   string
 	Target int
 	Type   string
 	FormId int
+	// 以下为v2字段，v1客户端收不到 / The following are v2 fields, v1 clients never see them
+	Id          string            `json:",omitempty"` // 服务端分配的唯一消息ID / Server-assigned unique message ID
+	Time        int64             `json:",omitempty"` // 服务端接收时间（毫秒时间戳） / Server receive time in unix milliseconds
+	ClientId    string            `json:",omitempty"` // 发送方客户端的消息ID / Sender client's message ID
+	ContentType string            `json:",omitempty"` // 内容类型，如text/plain / Content type, e.g. text/plain
+	Metadata    map[string]string `json:",omitempty"` // 自定义元数据 / Free-form metadata
+	Version     int               `json:",omitempty"` // 协议版本 / Protocol version
+	// Status 投递状态，仅用于节点之间转发的status消息 / Status is the delivery status, only used by status messages forwarded between nodes
+	Status string `json:",omitempty"`
 }
+
+// Encode 按协议版本编码消息：v1只保留原有字段，v2输出全部字段
+// Encode encodes the message for a protocol version: v1 keeps only the original fields, v2 emits every field
+func (r Response) Encode(version int) ([]byte, error) {
+	if version >= ProtocolV2 {
+		r.Version = ProtocolV2
+		return json.Marshal(r)
+	}
+	return json.Marshal(Response{Data: r.Data, Target: r.Target, Type: r.Type, FormId: r.FormId})
+}
+
+// SystemResponse 服务端产生的系统帧、错误帧或状态帧，Type为FrameSystem、FrameError或FrameStatus，Code为稳定的机器可读代码
+// SystemResponse is a server-originated system, error or status frame, Type is FrameSystem, FrameError or FrameStatus and Code is a stable machine-readable code
+type SystemResponse struct {
+	Type    string
+	Code    string
+	Id      string `json:",omitempty"` // 状态帧：相关消息的服务端消息ID / Status frames: server message ID of the related message
+	Message string // 便于排查的说明，客户端应以Code为准 / Human-readable detail, clients should rely on Code
+	Target  int    // 相关消息的目标 / Target of the related message
+	ReplyTo string // 相关客户端消息的ClientId / ClientId of the related client message
+	Time    int64  `json:",omitempty"` // v2：服务端时间戳（毫秒） / v2: server timestamp in unix milliseconds
+	Version int    `json:",omitempty"` // v2：协议版本 / v2: protocol version
+}
+
+// FrameSystem 系统帧类型 / FrameSystem is the system frame type
+const FrameSystem = "system"
+
+// FrameError 错误帧类型 / FrameError is the error frame type
+const FrameError = "error"
+
+// FrameStatus 消息投递状态帧类型（仅v2连接） / FrameStatus is the message delivery status frame type (v2 connections only)
+const FrameStatus = "status"
+
+// StatusSent 服务端已收到消息并交给接收方所在节点
+// StatusSent means the server received the message and handed it to the recipient's node
+const StatusSent = "SENT"
+
+// StatusDelivered 接收方客户端已确认收到消息
+// StatusDelivered means the recipient's client acknowledged the message
+const StatusDelivered = "DELIVERED"
+
+// StatusFailed 消息无法投递
+// StatusFailed means the message could not be delivered
+const StatusFailed = "FAILED"
+
+// CodeConnected 连接已建立，随初始帧发送
+// CodeConnected means the connection is established, sent with the initial frame
+const CodeConnected = "CONNECTED"
+
+// CodeUserOffline 目标用户不在线
+// CodeUserOffline means the target user is offline
+const CodeUserOffline = "USER_OFFLINE"
+
+// CodeInternalError 服务端内部错误
+// CodeInternalError means an internal server error
+const CodeInternalError = "INTERNAL_ERROR"
+
+// CodePublishFailed 消息未能交给消息代理
+// CodePublishFailed means the message could not be handed to the broker
+const CodePublishFailed = "PUBLISH_FAILED"
+
+// CodeInvalidMessage 消息不是合法的JSON
+// CodeInvalidMessage means the message is not valid JSON
+const CodeInvalidMessage = "INVALID_MESSAGE"
+
+// CodeInvalidType 消息类型不是group、once或ack
+// CodeInvalidType means the message type is not group, once or ack
+const CodeInvalidType = "INVALID_TYPE"
+
+// CodeInvalidTarget 消息目标超出范围
+// CodeInvalidTarget means the message target is out of range
+const CodeInvalidTarget = "INVALID_TARGET"
+
+// CodeInvalidAck 确认的消息不存在、已过期、已确认过或不是发给当前用户的
+// CodeInvalidAck means the acknowledged message is unknown, expired, already acknowledged or was not sent to the current user
+const CodeInvalidAck = "INVALID_ACK"
+
+// CodeDataTooLong 消息Data超过长度限制
+// CodeDataTooLong means the message Data exceeds the length limit
+const CodeDataTooLong = "DATA_TOO_LONG"
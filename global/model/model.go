@@ -1,7 +1,6 @@
 package model
 
 import (
-	"Gin/api/request"
 	"Gin/global/pkg"
 	"context"
 	"sync"
@@ -19,19 +18,23 @@ var Ctx = context.Background()
 // RDB is a Redis client instance, a globally shared Redis connection
 var RDB *redis.Client
 
-// OnlyMark 节点唯一标识，通过UUID生成，用于区分不同的服务节点
-// OnlyMark is a unique node identifier generated via UUID to distinguish different service nodes
+// OnlyMark 节点唯一标识，默认通过UUID生成，配置NODE_ID时使用固定标识，用于区分不同的服务节点
+// OnlyMark is a unique node identifier generated via UUID by default (a fixed one when NODE_ID is configured) to distinguish different service nodes
 var OnlyMark = uuid.NewString()
 
 // Logger Zap日志实例，用于全局日志记录
 // Logger is a Zap logger instance used for global logging
 var Logger *zap.Logger
 
-// ConnectionPool 用户连接池，存储当前节点上所有在线用户的WebSocket连接信息
-// ConnectionPool is a user connection pool that stores WebSocket connection information of all online users on the current node
-var ConnectionPool = make(map[int]request.Node)
+// Sessions 并发安全的用户会话注册表，存储当前节点上所有在线用户的WebSocket连接信息
+// Sessions is the concurrency-safe user session registry that stores WebSocket connection information of all online users on the current node
+var Sessions = pkg.NewRegistry[*pkg.Session](pkg.RegistryShards)
 
-// RabbieMqPoll RabbitMQ连接池，存储当前节点与各个RabbitMQ队列的连接
-// RabbieMqPoll is a RabbitMQ connection pool that stores connections between the current node and various RabbitMQ queues
-var RabbieMqPoll = make(map[string]*pkg.RabbitMQ)
+// Broker 消息代理，负责节点之间的消息投递（RabbitMQ、Redis Stream或内存实现）
+// Broker is the message broker that moves messages between nodes (RabbitMQ, Redis Streams or in-memory implementation)
+var Broker pkg.Broker
+
+// Fanout 集群广播，为nil时群聊消息逐个节点投递
+// Fanout is the cluster broadcast; group messages are delivered node by node when it is nil
+var Fanout pkg.Fanout
 var ActiveConnWG sync.WaitGroup
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNodeUnknown 目标节点未知（尚未建立连接或已下线）
+// ErrNodeUnknown means the target node is unknown (not connected yet or already offline)
+var ErrNodeUnknown = errors.New("broker: node unknown")
+
+// ErrBrokerClosed 消息代理已关闭
+// ErrBrokerClosed means the broker has already been closed
+var ErrBrokerClosed = errors.New("broker: closed")
+
+// Broker 消息代理接口，屏蔽具体消息中间件，负责节点之间的消息投递
+// Broker is the message broker interface that hides the concrete middleware and moves messages between nodes
+type Broker interface {
+	// Publish 向指定节点投递一条消息
+	// Publish delivers a message to the given node
+	Publish(node string, body []byte) error
+	// Consume 消费投递给当前节点的消息，可被多个消费者协程同时调用；每条消息处理后必须调用Ack或Reject之一
+	// Consume consumes messages addressed to the current node, may be called by several consumer goroutines; every delivery must end with Ack or Reject
+	Consume() (<-chan Delivery, error)
+	// Close 关闭消息代理并释放所有连接
+	// Close closes the broker and releases all connections
+	Close() error
+}
+
+// NodeSyncer 需要感知集群节点列表的消息代理实现该接口（如RabbitMQ简单模式需为每个节点维护连接）
+// NodeSyncer is implemented by brokers that need the cluster node list (e.g. RabbitMQ simple mode keeps one connection per node)
+type NodeSyncer interface {
+	// Sync 根据最新的节点列表建立或释放连接
+	// Sync establishes or releases connections according to the latest node list
+	Sync(nodes []string)
+}
+
+// DeadLetterQueue 死信队列名称，重试耗尽的消息进入该队列
+// DeadLetterQueue is the dead-letter queue name, messages whose retries are exhausted end up there
+const DeadLetterQueue = "ChatDeadLetter"
+
+// Delivery 节点收到的一条消息（手动确认模式）；重试由消费方在原处进行，不会重新入队，以免打乱同一目标的消息顺序
+// Delivery is a message received by the node (manual acknowledgement mode); retries happen in place at the consumer and never requeue, so messages to one target keep their order
+type Delivery struct {
+	// Body 消息体 / Body is the message body
+	Body []byte
+
+	ack    func() error
+	reject func(reason string) error
+}
+
+// Ack 确认消息已成功处理
+// Ack acknowledges the message as successfully processed
+func (d Delivery) Ack() error {
+	if d.ack == nil {
+		return nil
+	}
+	return d.ack()
+}
+
+// Reject 拒绝消息并将其转入死信队列，reason记录无法投递的原因
+// Reject rejects the message and moves it to the dead-letter queue, reason records why it could not be delivered
+func (d Delivery) Reject(reason string) error {
+	if d.reject == nil {
+		return nil
+	}
+	return d.reject(reason)
+}
+
+// DeadLetter 死信队列中的一条消息
+// DeadLetter is one message in the dead-letter queue
+type DeadLetter struct {
+	// ID 死信的唯一标识 / ID uniquely identifies the dead letter
+	ID string
+	// Body 原始消息体 / Body is the original message body
+	Body string
+	// Reason 无法投递的原因 / Reason is why the message could not be delivered
+	Reason string
+	// Node 拒绝该消息的节点 / Node is the node that rejected the message
+	Node string
+	// Time 进入死信队列的时间 / Time is when the message was dead-lettered
+	Time time.Time
+}
+
+// DeadLetterStore 支持查看和管理死信队列的消息代理实现该接口
+// DeadLetterStore is implemented by brokers whose dead-letter queue can be inspected and managed
+type DeadLetterStore interface {
+	// DeadLetters 返回最多limit条死信（不会将其移出队列）
+	// DeadLetters returns at most limit dead letters (without removing them from the queue)
+	DeadLetters(limit int) ([]DeadLetter, error)
+	// RemoveDeadLetter 删除指定的死信，不存在时返回ErrDeadLetterNotFound
+	// RemoveDeadLetter removes the given dead letter, returning ErrDeadLetterNotFound when it does not exist
+	RemoveDeadLetter(id string) error
+	// PurgeDeadLetters 清空死信队列并返回删除的条数
+	// PurgeDeadLetters empties the dead-letter queue and returns how many entries were removed
+	PurgeDeadLetters() (int, error)
+}
+
+// ErrDeadLetterNotFound 死信不存在
+// ErrDeadLetterNotFound means the dead letter does not exist
+var ErrDeadLetterNotFound = errors.New("broker: dead letter not found")
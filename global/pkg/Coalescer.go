@@ -0,0 +1,41 @@
+package pkg
+
+import "sync"
+
+// Coalescer 合并并发的重复请求：同一时间只执行一次fn，执行期间到达的所有请求合并为下一次执行
+// Coalescer merges concurrent duplicate requests: fn runs one at a time, and every request arriving during a run is merged into the next single run
+//
+// 每个调用者都会等待一次在其到达之后开始的执行，因此不会错过调用前发生的变化
+// Every caller waits for a run that started after it arrived, so no change made before the call is missed
+type Coalescer struct {
+	mu      sync.Mutex
+	running bool
+	// waiters 等待下一次执行的调用者 / waiters are the callers waiting for the next run
+	waiters []chan struct{}
+}
+
+// Do 请求执行一次fn，并阻塞到覆盖本次请求的执行结束
+// Do requests a run of fn and blocks until a run covering this request has finished
+func (c *Coalescer) Do(fn func()) {
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.waiters = append(c.waiters, done)
+	if c.running {
+		c.mu.Unlock()
+		<-done
+		return
+	}
+	c.running = true
+	for len(c.waiters) > 0 {
+		batch := c.waiters
+		c.waiters = nil
+		c.mu.Unlock()
+		fn()
+		for _, waiter := range batch {
+			close(waiter)
+		}
+		c.mu.Lock()
+	}
+	c.running = false
+	c.mu.Unlock()
+}
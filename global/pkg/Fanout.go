@@ -0,0 +1,15 @@
+package pkg
+
+// Fanout 集群广播接口：群聊消息只发布一次，由所有订阅的节点各自接收一份
+// Fanout is the cluster broadcast interface: a group message is published once and every subscribed node receives its own copy
+type Fanout interface {
+	// Broadcast 向集群内所有节点广播一条消息
+	// Broadcast broadcasts a message to every node in the cluster
+	Broadcast(body []byte) error
+	// Subscribe 订阅集群广播
+	// Subscribe subscribes to cluster broadcasts
+	Subscribe() (<-chan []byte, error)
+	// Close 取消订阅并释放资源
+	// Close unsubscribes and releases resources
+	Close() error
+}
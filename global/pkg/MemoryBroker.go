@@ -0,0 +1,171 @@
+package pkg
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryQueueSize 内存队列容量
+// MemoryQueueSize is the capacity of each in-memory queue
+const MemoryQueueSize = 4096
+
+// ErrQueueFull 内存队列已满
+// ErrQueueFull means the in-memory queue is full
+var ErrQueueFull = errors.New("broker: queue full")
+
+// memoryHub 进程内的消息中枢，同一中枢上的多个节点可以互相投递（用于单节点部署和测试）
+// memoryHub is an in-process message hub; nodes on the same hub can deliver to each other (single-node deployments and tests)
+type memoryHub struct {
+	mu     sync.RWMutex
+	queues map[string]chan memoryMessage
+	// deadLetters 死信队列 / deadLetters is the dead-letter queue
+	deadLetters []DeadLetter
+	// deadLetterSeq 死信编号 / deadLetterSeq numbers the dead letters
+	deadLetterSeq int
+	closed        bool
+}
+
+// memoryMessage 内存队列中的一条消息 / memoryMessage is one message in an in-memory queue
+type memoryMessage struct {
+	body []byte
+}
+
+// MemoryBroker 基于channel的进程内消息代理
+// MemoryBroker is an in-process, channel based message broker
+type MemoryBroker struct {
+	mark string
+	hub  *memoryHub
+}
+
+// NewMemoryBroker 创建一个新的内存中枢，并以mark作为当前节点加入
+// NewMemoryBroker creates a new in-memory hub and joins it as node mark
+func NewMemoryBroker(mark string) *MemoryBroker {
+	hub := &memoryHub{queues: make(map[string]chan memoryMessage)}
+	return join(hub, mark)
+}
+
+// Join 以另一个节点标识加入同一个内存中枢，模拟多节点集群
+// Join joins the same in-memory hub under another node mark to simulate a multi-node cluster
+func (m *MemoryBroker) Join(mark string) *MemoryBroker {
+	return join(m.hub, mark)
+}
+
+func join(hub *memoryHub, mark string) *MemoryBroker {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if _, ok := hub.queues[mark]; !ok {
+		hub.queues[mark] = make(chan memoryMessage, MemoryQueueSize)
+	}
+	return &MemoryBroker{mark: mark, hub: hub}
+}
+
+// Publish 向指定节点的内存队列投递消息，队列满时返回ErrQueueFull而不是阻塞
+// Publish delivers a message to the node's in-memory queue, returning ErrQueueFull instead of blocking when full
+func (m *MemoryBroker) Publish(node string, body []byte) error {
+	return m.hub.enqueue(node, memoryMessage{body: body})
+}
+
+func (h *memoryHub) enqueue(node string, message memoryMessage) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return ErrBrokerClosed
+	}
+	queue, ok := h.queues[node]
+	if !ok {
+		return ErrNodeUnknown
+	}
+	select {
+	case queue <- message:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Consume 消费当前节点的内存队列；Reject放入死信队列
+// Consume consumes the current node's in-memory queue; Reject moves the message to the dead-letter queue
+func (m *MemoryBroker) Consume() (<-chan Delivery, error) {
+	m.hub.mu.RLock()
+	queue := m.hub.queues[m.mark]
+	closed := m.hub.closed
+	m.hub.mu.RUnlock()
+	if closed {
+		return nil, ErrBrokerClosed
+	}
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for message := range queue {
+			out <- Delivery{
+				Body: message.body,
+				reject: func(reason string) error {
+					m.hub.mu.Lock()
+					defer m.hub.mu.Unlock()
+					m.hub.deadLetterSeq++
+					m.hub.deadLetters = append(m.hub.deadLetters, DeadLetter{
+						ID:     strconv.Itoa(m.hub.deadLetterSeq),
+						Body:   string(message.body),
+						Reason: reason,
+						Node:   m.mark,
+						Time:   time.Now(),
+					})
+					return nil
+				},
+			}
+		}
+	}()
+	return out, nil
+}
+
+// DeadLetters 返回最早的limit条死信
+// DeadLetters returns the oldest limit dead letters
+func (m *MemoryBroker) DeadLetters(limit int) ([]DeadLetter, error) {
+	m.hub.mu.RLock()
+	defer m.hub.mu.RUnlock()
+	if limit > len(m.hub.deadLetters) {
+		limit = len(m.hub.deadLetters)
+	}
+	return append([]DeadLetter(nil), m.hub.deadLetters[:limit]...), nil
+}
+
+// RemoveDeadLetter 删除指定的死信
+// RemoveDeadLetter removes the given dead letter
+func (m *MemoryBroker) RemoveDeadLetter(id string) error {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	for i, letter := range m.hub.deadLetters {
+		if letter.ID == id {
+			m.hub.deadLetters = append(m.hub.deadLetters[:i], m.hub.deadLetters[i+1:]...)
+			return nil
+		}
+	}
+	return ErrDeadLetterNotFound
+}
+
+// PurgeDeadLetters 清空死信队列
+// PurgeDeadLetters empties the dead-letter queue
+func (m *MemoryBroker) PurgeDeadLetters() (int, error) {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	count := len(m.hub.deadLetters)
+	m.hub.deadLetters = nil
+	return count, nil
+}
+
+// Close 关闭中枢上的所有队列，消费者的range循环随之结束
+// Close closes every queue on the hub, ending the consumers' range loops
+func (m *MemoryBroker) Close() error {
+	m.hub.mu.Lock()
+	defer m.hub.mu.Unlock()
+	if m.hub.closed {
+		return nil
+	}
+	m.hub.closed = true
+	for _, queue := range m.hub.queues {
+		close(queue)
+	}
+	return nil
+}
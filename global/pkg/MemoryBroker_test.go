@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// receive 从消费通道取一条消息，超时则测试失败
+// receive takes one delivery from the consuming channel, failing the test on timeout
+func receive(t *testing.T, deliveries <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case delivery, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return delivery
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+	return Delivery{}
+}
+
+// TestMemoryBrokerCluster 同一中枢上的节点可以互相投递，每个节点只收到发给自己的消息
+// TestMemoryBrokerCluster checks nodes on one hub deliver to each other and each node only receives its own messages
+func TestMemoryBrokerCluster(t *testing.T) {
+	a := NewMemoryBroker("a")
+	b := a.Join("b")
+	defer a.Close()
+
+	fromA, err := a.Consume()
+	if err != nil {
+		t.Fatalf("Consume a: %v", err)
+	}
+	fromB, err := b.Consume()
+	if err != nil {
+		t.Fatalf("Consume b: %v", err)
+	}
+	if err := a.Publish("b", []byte("to b")); err != nil {
+		t.Fatalf("Publish to b: %v", err)
+	}
+	if err := b.Publish("a", []byte("to a")); err != nil {
+		t.Fatalf("Publish to a: %v", err)
+	}
+	if got := string(receive(t, fromB).Body); got != "to b" {
+		t.Fatalf("b received %q, want %q", got, "to b")
+	}
+	if got := string(receive(t, fromA).Body); got != "to a" {
+		t.Fatalf("a received %q, want %q", got, "to a")
+	}
+	if err := a.Publish("c", []byte("lost")); !errors.Is(err, ErrNodeUnknown) {
+		t.Fatalf("Publish to unknown node = %v, want ErrNodeUnknown", err)
+	}
+}
+
+// TestMemoryBrokerAckReject Ack后消息不再出现，Reject的消息进入死信队列并可删除和清空
+// TestMemoryBrokerAckReject checks an acked message is gone and rejected messages land in the dead-letter queue, which can be pruned and purged
+func TestMemoryBrokerAckReject(t *testing.T) {
+	broker := NewMemoryBroker("node")
+	defer broker.Close()
+	deliveries, err := broker.Consume()
+	if err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	for _, body := range []string{"ok", "bad-1", "bad-2"} {
+		if err := broker.Publish("node", []byte(body)); err != nil {
+			t.Fatalf("Publish %q: %v", body, err)
+		}
+	}
+	if err := receive(t, deliveries).Ack(); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := receive(t, deliveries).Reject("target offline"); err != nil {
+			t.Fatalf("Reject: %v", err)
+		}
+	}
+
+	letters, err := broker.DeadLetters(10)
+	if err != nil {
+		t.Fatalf("DeadLetters: %v", err)
+	}
+	if len(letters) != 2 || letters[0].Body != "bad-1" || letters[1].Body != "bad-2" {
+		t.Fatalf("DeadLetters = %+v, want bad-1 and bad-2", letters)
+	}
+	if letters[0].Reason != "target offline" || letters[0].Node != "node" {
+		t.Fatalf("dead letter = %+v, want reason and node recorded", letters[0])
+	}
+	if err := broker.RemoveDeadLetter(letters[0].ID); err != nil {
+		t.Fatalf("RemoveDeadLetter: %v", err)
+	}
+	if err := broker.RemoveDeadLetter(letters[0].ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf("second RemoveDeadLetter = %v, want ErrDeadLetterNotFound", err)
+	}
+	if count, err := broker.PurgeDeadLetters(); err != nil || count != 1 {
+		t.Fatalf("PurgeDeadLetters = %d, %v, want 1", count, err)
+	}
+	if letters, _ := broker.DeadLetters(10); len(letters) != 0 {
+		t.Fatalf("DeadLetters after purge = %+v, want none", letters)
+	}
+}
+
+// TestMemoryBrokerClose 关闭后消费通道结束，发布返回ErrBrokerClosed
+// TestMemoryBrokerClose checks the consuming channel ends after Close and publishing returns ErrBrokerClosed
+func TestMemoryBrokerClose(t *testing.T) {
+	broker := NewMemoryBroker("node")
+	deliveries, err := broker.Consume()
+	if err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	if err := broker.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Fatal("unexpected delivery after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries not closed")
+	}
+	if err := broker.Publish("node", []byte("late")); !errors.Is(err, ErrBrokerClosed) {
+		t.Fatalf("Publish after Close = %v, want ErrBrokerClosed", err)
+	}
+	if _, err := broker.Consume(); !errors.Is(err, ErrBrokerClosed) {
+		t.Fatalf("Consume after Close = %v, want ErrBrokerClosed", err)
+	}
+}
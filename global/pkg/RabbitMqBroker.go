@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// RabbitMqBroker 基于RabbitMQ简单模式的消息代理：每个节点对应一个以节点标识命名的队列
+// RabbitMqBroker is a broker built on RabbitMQ simple mode: every node owns a queue named after its node mark
+type RabbitMqBroker struct {
+	mark string
+	mu   sync.RWMutex
+	// pool 节点标识到RabbitMQ连接的映射 / pool maps node marks to RabbitMQ connections
+	pool map[string]*RabbitMQ
+	// syncMu 串行化Sync，建立连接时不持有mu，不阻塞发布
+	// syncMu serializes Sync; mu is not held while dialing so publishing is never blocked
+	syncMu sync.Mutex
+	closed bool
+}
+
+// NewRabbitMqBroker 创建RabbitMQ消息代理，并立即建立当前节点自身队列的连接
+// NewRabbitMqBroker creates a RabbitMQ broker and immediately connects the current node's own queue
+func NewRabbitMqBroker(mark string) *RabbitMqBroker {
+	return &RabbitMqBroker{
+		mark: mark,
+		pool: map[string]*RabbitMQ{mark: NewRabbitMQSimple(mark)},
+	}
+}
+
+// Publish 向目标节点的队列发布消息，未建立连接时返回ErrNodeUnknown，重连期间返回ErrDisconnected
+// Publish publishes the message to the target node's queue, returning ErrNodeUnknown when not connected and ErrDisconnected while reconnecting
+func (b *RabbitMqBroker) Publish(node string, body []byte) error {
+	b.mu.RLock()
+	mq, ok := b.pool[node]
+	b.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNodeUnknown, node)
+	}
+	return mq.PublishSimple(string(body))
+}
+
+// Consume 以手动确认模式消费当前节点自身的队列
+// Consume consumes the current node's own queue in manual acknowledgement mode
+func (b *RabbitMqBroker) Consume() (<-chan Delivery, error) {
+	mq, err := b.own()
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := mq.ConsumeSimple()
+	if err != nil {
+		return nil, err
+	}
+	return manualDeliveries(mq, b.mark, deliveries), nil
+}
+
+// deliveryBodies 将自动确认的RabbitMQ投递转换为消息体通道
+// deliveryBodies converts auto-acknowledged RabbitMQ deliveries into a channel of message bodies
+func deliveryBodies(deliveries <-chan amqp.Delivery) <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for delivery := range deliveries {
+			out <- delivery.Body
+		}
+	}()
+	return out
+}
+
+// manualDeliveries 将手动确认的RabbitMQ投递转换为Delivery：Reject转入死信队列后确认原消息
+// manualDeliveries converts manually acknowledged RabbitMQ deliveries into Delivery values: Reject moves it to the dead-letter queue and acks the original
+func manualDeliveries(mq *RabbitMQ, node string, deliveries <-chan amqp.Delivery) <-chan Delivery {
+	out := make(chan Delivery)
+	go func() {
+		defer close(out)
+		for delivery := range deliveries {
+			out <- Delivery{
+				Body: delivery.Body,
+				ack: func() error {
+					return delivery.Ack(false)
+				},
+				reject: func(reason string) error {
+					if err := mq.PublishDeadLetter(string(delivery.Body), reason, node); err != nil {
+						// 转入死信队列失败时交给broker原样重新投递
+						// Let the broker redeliver the original when dead-lettering fails
+						delivery.Nack(false, true)
+						return err
+					}
+					return delivery.Ack(false)
+				},
+			}
+		}
+	}()
+	return out
+}
+
+// DeadLetters 查看共享的死信队列
+// DeadLetters inspects the shared dead-letter queue
+func (b *RabbitMqBroker) DeadLetters(limit int) ([]DeadLetter, error) {
+	mq, err := b.own()
+	if err != nil {
+		return nil, err
+	}
+	return mq.PeekDeadLetters(limit)
+}
+
+// RemoveDeadLetter 删除指定的死信
+// RemoveDeadLetter removes the given dead letter
+func (b *RabbitMqBroker) RemoveDeadLetter(id string) error {
+	mq, err := b.own()
+	if err != nil {
+		return err
+	}
+	return mq.RemoveDeadLetter(id)
+}
+
+// PurgeDeadLetters 清空死信队列
+// PurgeDeadLetters empties the dead-letter queue
+func (b *RabbitMqBroker) PurgeDeadLetters() (int, error) {
+	mq, err := b.own()
+	if err != nil {
+		return 0, err
+	}
+	return mq.PurgeDeadLetters()
+}
+
+// own 返回当前节点自身队列的连接
+// own returns the connection of the node's own queue
+func (b *RabbitMqBroker) own() (*RabbitMQ, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	mq, ok := b.pool[b.mark]
+	if !ok {
+		return nil, ErrBrokerClosed
+	}
+	return mq, nil
+}
+
+// Sync 为新节点建立连接，并销毁已不存在节点的连接（当前节点自身的连接始终保留）；多次调用串行执行
+// Sync connects new nodes and destroys connections of nodes that no longer exist (the own connection is always kept); calls run one at a time
+func (b *RabbitMqBroker) Sync(nodes []string) {
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	// 先在读锁下计算差异，建立连接期间发布不受影响
+	// Work out the difference under the read lock first, so publishing is unaffected while dialing
+	connected := map[string]bool{b.mark: true}
+	var added []string
+	b.mu.RLock()
+	for _, node := range nodes {
+		if connected[node] {
+			continue
+		}
+		connected[node] = true
+		if _, ok := b.pool[node]; !ok {
+			added = append(added, node)
+		}
+	}
+	b.mu.RUnlock()
+
+	dialed := make(map[string]*RabbitMQ, len(added))
+	for _, node := range added {
+		dialed[node] = NewRabbitMQSimple(node)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// 期间已关闭时丢弃新建的连接
+	// Drop the new connections when the broker was closed meanwhile
+	if b.closed {
+		for _, mq := range dialed {
+			mq.Destory()
+		}
+		return
+	}
+	for node, mq := range dialed {
+		b.pool[node] = mq
+	}
+	for node, mq := range b.pool {
+		if !connected[node] {
+			mq.Destory()
+			delete(b.pool, node)
+		}
+	}
+}
+
+// Close 销毁所有RabbitMQ连接
+// Close destroys all RabbitMQ connections
+func (b *RabbitMqBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for node, mq := range b.pool {
+		mq.Destory()
+		delete(b.pool, node)
+	}
+	return nil
+}
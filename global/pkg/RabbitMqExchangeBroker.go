@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// DirectExchange 私聊消息使用的direct交换机，路由key为目标节点标识
+	// DirectExchange is the direct exchange for private messages, the routing key is the target node mark
+	DirectExchange = "ChatDirect"
+	// FanoutExchange 群聊广播使用的fanout交换机
+	// FanoutExchange is the fanout exchange for group broadcasts
+	FanoutExchange = "ChatFanout"
+	// groupQueueSuffix 节点接收群聊广播的队列后缀 / groupQueueSuffix is the suffix of the node queue receiving group broadcasts
+	groupQueueSuffix = ".group"
+)
+
+// RabbitMqExchangeBroker 基于RabbitMQ direct交换机的消息代理：节点只绑定一次自身队列，发送方无需为每个节点维护连接
+// RabbitMqExchangeBroker is a broker built on a RabbitMQ direct exchange: a node binds its own queue once and senders keep no per-node connections
+type RabbitMqExchangeBroker struct {
+	mq *RabbitMQ
+}
+
+// NewRabbitMqExchangeBroker 创建交换机模式的RabbitMQ消息代理
+// NewRabbitMqExchangeBroker creates an exchange mode RabbitMQ broker
+func NewRabbitMqExchangeBroker(mark string) *RabbitMqExchangeBroker {
+	return &RabbitMqExchangeBroker{mq: NewRabbitMQRouting(DirectExchange, mark)}
+}
+
+// Publish 以目标节点标识作为路由key发布消息，没有节点队列绑定该key时返回ErrNodeUnknown
+// Publish publishes the message with the target node mark as routing key, returning ErrNodeUnknown when no node queue is bound to it
+func (b *RabbitMqExchangeBroker) Publish(node string, body []byte) error {
+	err := b.mq.PublishRouting(node, string(body))
+	if errors.Is(err, ErrUnroutable) {
+		return fmt.Errorf("%w: %w", ErrNodeUnknown, err)
+	}
+	return err
+}
+
+// Consume 以手动确认模式消费按当前节点标识绑定的队列
+// Consume consumes the queue bound with the current node mark in manual acknowledgement mode
+func (b *RabbitMqExchangeBroker) Consume() (<-chan Delivery, error) {
+	deliveries, err := b.mq.RecieveRouting()
+	if err != nil {
+		return nil, err
+	}
+	return manualDeliveries(b.mq, b.mq.Key, deliveries), nil
+}
+
+// DeadLetters 查看共享的死信队列
+// DeadLetters inspects the shared dead-letter queue
+func (b *RabbitMqExchangeBroker) DeadLetters(limit int) ([]DeadLetter, error) {
+	return b.mq.PeekDeadLetters(limit)
+}
+
+// RemoveDeadLetter 删除指定的死信
+// RemoveDeadLetter removes the given dead letter
+func (b *RabbitMqExchangeBroker) RemoveDeadLetter(id string) error {
+	return b.mq.RemoveDeadLetter(id)
+}
+
+// PurgeDeadLetters 清空死信队列
+// PurgeDeadLetters empties the dead-letter queue
+func (b *RabbitMqExchangeBroker) PurgeDeadLetters() (int, error) {
+	return b.mq.PurgeDeadLetters()
+}
+
+// Close 断开RabbitMQ连接
+// Close disconnects from RabbitMQ
+func (b *RabbitMqExchangeBroker) Close() error {
+	b.mq.Destory()
+	return nil
+}
+
+// RabbitMqFanout 基于RabbitMQ fanout交换机的集群广播，每个节点绑定一个接收广播的队列
+// RabbitMqFanout is a cluster broadcast built on a RabbitMQ fanout exchange, every node binds one queue for broadcasts
+type RabbitMqFanout struct {
+	mq *RabbitMQ
+}
+
+// NewRabbitMqFanout 创建RabbitMQ集群广播
+// NewRabbitMqFanout creates a RabbitMQ cluster broadcast
+func NewRabbitMqFanout(mark string) *RabbitMqFanout {
+	return &RabbitMqFanout{mq: NewRabbitMQPubSub(FanoutExchange, mark+groupQueueSuffix)}
+}
+
+// Broadcast 向fanout交换机发布消息
+// Broadcast publishes the message to the fanout exchange
+func (f *RabbitMqFanout) Broadcast(body []byte) error {
+	return f.mq.PublishPub(string(body))
+}
+
+// Subscribe 绑定当前节点的广播队列并开始消费
+// Subscribe binds the node's broadcast queue and starts consuming it
+func (f *RabbitMqFanout) Subscribe() (<-chan []byte, error) {
+	deliveries, err := f.mq.RecieveSub()
+	if err != nil {
+		return nil, err
+	}
+	return deliveryBodies(deliveries), nil
+}
+
+// Close 断开RabbitMQ连接
+// Close disconnects from RabbitMQ
+func (f *RabbitMqFanout) Close() error {
+	f.mq.Destory()
+	return nil
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FanoutChannel 集群广播使用的Redis Pub/Sub频道
+// FanoutChannel is the Redis Pub/Sub channel used for cluster broadcasts
+const FanoutChannel = "ChatBroadcast"
+
+// RedisFanout 基于Redis Pub/Sub的集群广播；Pub/Sub不持久化，订阅断开期间的消息会丢失
+// RedisFanout is a cluster broadcast built on Redis Pub/Sub; Pub/Sub is not persistent, messages sent while a subscriber is disconnected are lost
+type RedisFanout struct {
+	rdb    *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	pubsub *redis.PubSub
+}
+
+// NewRedisFanout 创建Redis Pub/Sub集群广播
+// NewRedisFanout creates a Redis Pub/Sub cluster broadcast
+func NewRedisFanout(rdb *redis.Client) *RedisFanout {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RedisFanout{rdb: rdb, ctx: ctx, cancel: cancel}
+}
+
+// Broadcast 向广播频道发布消息
+// Broadcast publishes the message on the broadcast channel
+func (f *RedisFanout) Broadcast(body []byte) error {
+	if f.ctx.Err() != nil {
+		return ErrBrokerClosed
+	}
+	return f.rdb.Publish(f.ctx, FanoutChannel, body).Err()
+}
+
+// Subscribe 订阅广播频道，订阅确认后才返回，避免错过订阅建立期间的消息
+// Subscribe subscribes to the broadcast channel and returns only after the subscription is confirmed
+func (f *RedisFanout) Subscribe() (<-chan []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ctx.Err() != nil {
+		return nil, ErrBrokerClosed
+	}
+	pubsub := f.rdb.Subscribe(f.ctx, FanoutChannel)
+	if _, err := pubsub.Receive(f.ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	f.pubsub = pubsub
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for message := range pubsub.Channel() {
+			select {
+			case out <- []byte(message.Payload):
+			case <-f.ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Close 取消订阅，订阅通道随之关闭
+// Close unsubscribes, which closes the subscription channel
+func (f *RedisFanout) Close() error {
+	f.cancel()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pubsub != nil {
+		return f.pubsub.Close()
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// StreamPrefix 节点消息流的键前缀，完整键为 Stream:<节点标识>
+	// StreamPrefix is the key prefix of node streams, the full key is Stream:<node mark>
+	StreamPrefix = "Stream:"
+	// StreamGroup 节点消费自身消息流时使用的消费者组
+	// StreamGroup is the consumer group a node uses to consume its own stream
+	StreamGroup = "ChatGroup"
+	// StreamMaxLen 每个消息流保留的大致最大长度，防止无人消费时无限增长
+	// StreamMaxLen is the approximate maximum length kept per stream, preventing unbounded growth
+	StreamMaxLen = 10000
+	// DeadLetterStream 死信消息流 / DeadLetterStream is the dead-letter stream
+	DeadLetterStream = StreamPrefix + DeadLetterQueue
+	// streamBlock 单次XREADGROUP的阻塞时长 / streamBlock is the blocking time of one XREADGROUP
+	streamBlock = 5 * time.Second
+	// streamBatch 单次XREADGROUP读取的最大条数 / streamBatch is the maximum entries read by one XREADGROUP
+	streamBatch = 64
+)
+
+// RedisStreamBroker 基于Redis Stream的消息代理：每个节点对应一个消息流，通过消费者组读取并确认；
+// 消息流和消费者以节点标识命名，节点须使用固定标识，重启后才能读到上一次运行未确认的消息
+// RedisStreamBroker is a broker built on Redis Streams: every node owns a stream, read and acknowledged through a consumer group;
+// the stream and consumer are named after the node mark, so nodes must use a fixed identifier to read the entries left unacknowledged by their previous run
+type RedisStreamBroker struct {
+	rdb    *redis.Client
+	mark   string
+	stream string
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+	out    chan Delivery
+	done   chan struct{}
+}
+
+// NewRedisStreamBroker 创建Redis Stream消息代理，并确保当前节点的消息流和消费者组存在
+// NewRedisStreamBroker creates a Redis Stream broker and makes sure the node's stream and consumer group exist
+func NewRedisStreamBroker(rdb *redis.Client, mark string) (*RedisStreamBroker, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &RedisStreamBroker{
+		rdb:    rdb,
+		mark:   mark,
+		stream: StreamPrefix + mark,
+		ctx:    ctx,
+		cancel: cancel,
+		out:    make(chan Delivery),
+		done:   make(chan struct{}),
+	}
+	// 消费者组已存在（节点重启）时忽略BUSYGROUP错误，未确认的消息仍保留在组内
+	// Ignore BUSYGROUP when the group already exists (node restart), unacknowledged entries stay in the group
+	err := rdb.XGroupCreateMkStream(ctx, b.stream, StreamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		cancel()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Publish 向目标节点的消息流追加消息，消息流不存在时返回ErrNodeUnknown
+// Publish appends the message to the target node's stream, returning ErrNodeUnknown when the stream does not exist
+func (b *RedisStreamBroker) Publish(node string, body []byte) error {
+	if b.ctx.Err() != nil {
+		return ErrBrokerClosed
+	}
+	err := b.rdb.XAdd(b.ctx, &redis.XAddArgs{
+		Stream:     StreamPrefix + node,
+		NoMkStream: true,
+		MaxLen:     StreamMaxLen,
+		Approx:     true,
+		Values:     map[string]interface{}{"body": body},
+	}).Err()
+	if errors.Is(err, redis.Nil) {
+		return ErrNodeUnknown
+	}
+	return err
+}
+
+// Consume 返回当前节点消息流的消费通道，多次调用共享同一个读取协程；消息在Ack前一直留在消费者组的待处理列表中
+// Consume returns the consuming channel of the node's stream, all calls share one reading goroutine; entries stay in the group's pending list until acked
+func (b *RedisStreamBroker) Consume() (<-chan Delivery, error) {
+	if b.ctx.Err() != nil {
+		return nil, ErrBrokerClosed
+	}
+	b.once.Do(func() {
+		go b.run()
+	})
+	return b.out, nil
+}
+
+// run 先读取重启前未确认的消息，再持续读取新消息
+// run first reads entries left unacknowledged before a restart, then keeps reading new ones
+func (b *RedisStreamBroker) run() {
+	defer close(b.done)
+	defer close(b.out)
+	id := "0"
+	for b.ctx.Err() == nil {
+		streams, err := b.rdb.XReadGroup(b.ctx, &redis.XReadGroupArgs{
+			Group:    StreamGroup,
+			Consumer: b.mark,
+			Streams:  []string{b.stream, id},
+			Count:    streamBatch,
+			Block:    streamBlock,
+		}).Result()
+		if err != nil {
+			// 节点被误判下线时消息流可能已被清理，重新创建消息流和消费者组
+			// The stream may have been cleaned up while the node was wrongly declared dead, recreate the stream and consumer group
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				if err := b.rdb.XGroupCreateMkStream(b.ctx, b.stream, StreamGroup, "0").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+			if !errors.Is(err, redis.Nil) && b.ctx.Err() == nil {
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if len(streams) == 0 || len(streams[0].Messages) == 0 {
+			// 待处理列表已读完，切换为读取新消息
+			// The pending list is drained, switch to new entries
+			id = ">"
+			continue
+		}
+		for _, message := range streams[0].Messages {
+			body, ok := message.Values["body"].(string)
+			if !ok {
+				b.rdb.XAck(b.ctx, b.stream, StreamGroup, message.ID)
+				continue
+			}
+			select {
+			case b.out <- b.delivery(message.ID, body):
+			case <-b.ctx.Done():
+				return
+			}
+		}
+		// 读取待处理列表时从本批最后一条之后继续，已交出但尚未确认的条目不会被再次读到
+		// While reading the pending list continue after the last entry of this batch, so entries handed out but not acked yet are not read again
+		if id != ">" {
+			id = streams[0].Messages[len(streams[0].Messages)-1].ID
+		}
+	}
+}
+
+// delivery 构造消息流条目的Delivery：Reject追加到死信消息流后确认原条目
+// delivery builds the Delivery of a stream entry: Reject appends it to the dead-letter stream and acks the original entry
+func (b *RedisStreamBroker) delivery(id string, body string) Delivery {
+	ack := func() error {
+		return b.rdb.XAck(context.Background(), b.stream, StreamGroup, id).Err()
+	}
+	return Delivery{
+		Body: []byte(body),
+		ack:  ack,
+		reject: func(reason string) error {
+			err := b.rdb.XAdd(context.Background(), &redis.XAddArgs{
+				Stream: DeadLetterStream,
+				MaxLen: StreamMaxLen,
+				Approx: true,
+				Values: map[string]interface{}{
+					"body":   body,
+					"reason": reason,
+					"node":   b.mark,
+					"time":   time.Now().Unix(),
+				},
+			}).Err()
+			if err != nil {
+				return err
+			}
+			return ack()
+		},
+	}
+}
+
+// DeadLetters 返回死信消息流中最早的limit条死信，条目ID即死信ID
+// DeadLetters returns the oldest limit entries of the dead-letter stream, the entry ID is the dead letter ID
+func (b *RedisStreamBroker) DeadLetters(limit int) ([]DeadLetter, error) {
+	messages, err := b.rdb.XRangeN(context.Background(), DeadLetterStream, "-", "+", int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(messages))
+	for _, message := range messages {
+		letter := DeadLetter{ID: message.ID}
+		letter.Body, _ = message.Values["body"].(string)
+		letter.Reason, _ = message.Values["reason"].(string)
+		letter.Node, _ = message.Values["node"].(string)
+		if value, ok := message.Values["time"].(string); ok {
+			if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+				letter.Time = time.Unix(unix, 0)
+			}
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// RemoveDeadLetter 从死信消息流中删除指定条目
+// RemoveDeadLetter deletes the given entry from the dead-letter stream
+func (b *RedisStreamBroker) RemoveDeadLetter(id string) error {
+	removed, err := b.rdb.XDel(context.Background(), DeadLetterStream, id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// PurgeDeadLetters 删除整个死信消息流
+// PurgeDeadLetters deletes the whole dead-letter stream
+func (b *RedisStreamBroker) PurgeDeadLetters() (int, error) {
+	count, err := b.rdb.XLen(context.Background(), DeadLetterStream).Result()
+	if err != nil {
+		return 0, err
+	}
+	if err := b.rdb.Del(context.Background(), DeadLetterStream).Err(); err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// Close 停止读取协程；消息流本身保留，未确认的消息在节点重启后继续投递
+// Close stops the reading goroutine; the stream itself is kept so unacknowledged entries are delivered after a restart
+func (b *RedisStreamBroker) Close() error {
+	b.cancel()
+	// 读取协程未启动时由这里关闭通道，否则等待读取协程退出
+	// Close the channels here when the reading goroutine never started, otherwise wait for it to exit
+	b.once.Do(func() {
+		close(b.out)
+		close(b.done)
+	})
+	<-b.done
+	return nil
+}
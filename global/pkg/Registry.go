@@ -0,0 +1,118 @@
+package pkg
+
+import "sync"
+
+// RegistryShards 会话注册表默认分片数
+// RegistryShards is the default number of session registry shards
+const RegistryShards = 32
+
+// Registry 按用户ID分片加锁的并发安全注册表，读写只锁定所在分片，减少多个连接和消费者协程之间的锁竞争
+// Registry is a concurrency-safe registry sharded by user ID; reads and writes only lock their own shard, reducing lock contention between connection and consumer goroutines
+type Registry[V comparable] struct {
+	shards []registryShard[V]
+}
+
+// registryShard 注册表的一个分片 / registryShard is one shard of the registry
+type registryShard[V comparable] struct {
+	mu    sync.RWMutex
+	items map[int]V
+}
+
+// NewRegistry 创建一个包含shards个分片的注册表，shards不大于0时使用RegistryShards
+// NewRegistry creates a registry with shards shards, using RegistryShards when shards is not positive
+func NewRegistry[V comparable](shards int) *Registry[V] {
+	if shards <= 0 {
+		shards = RegistryShards
+	}
+	r := &Registry[V]{shards: make([]registryShard[V], shards)}
+	for i := range r.shards {
+		r.shards[i].items = make(map[int]V)
+	}
+	return r
+}
+
+// shard 返回id所在的分片 / shard returns the shard that holds id
+func (r *Registry[V]) shard(id int) *registryShard[V] {
+	index := id % len(r.shards)
+	if index < 0 {
+		index += len(r.shards)
+	}
+	return &r.shards[index]
+}
+
+// Add 登记id对应的值，已存在时覆盖
+// Add registers the value for id, replacing an existing one
+func (r *Registry[V]) Add(id int, value V) {
+	shard := r.shard(id)
+	shard.mu.Lock()
+	shard.items[id] = value
+	shard.mu.Unlock()
+}
+
+// Remove 移除id对应的值
+// Remove removes the value for id
+func (r *Registry[V]) Remove(id int) {
+	shard := r.shard(id)
+	shard.mu.Lock()
+	delete(shard.items, id)
+	shard.mu.Unlock()
+}
+
+// CompareAndRemove 仅当id对应的值仍是value时才移除，返回是否移除；id已被新值覆盖时保留新值
+// CompareAndRemove removes the value for id only while it is still value, reporting whether it was removed; a newer value registered under id is kept
+func (r *Registry[V]) CompareAndRemove(id int, value V) bool {
+	shard := r.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if current, ok := shard.items[id]; !ok || current != value {
+		return false
+	}
+	delete(shard.items, id)
+	return true
+}
+
+// Get 获取id对应的值，ok表示是否存在
+// Get gets the value for id, ok reports whether it exists
+func (r *Registry[V]) Get(id int) (value V, ok bool) {
+	shard := r.shard(id)
+	shard.mu.RLock()
+	value, ok = shard.items[id]
+	shard.mu.RUnlock()
+	return value, ok
+}
+
+// Len 返回登记的条目数
+// Len returns the number of registered entries
+func (r *Registry[V]) Len() int {
+	count := 0
+	for i := range r.shards {
+		r.shards[i].mu.RLock()
+		count += len(r.shards[i].items)
+		r.shards[i].mu.RUnlock()
+	}
+	return count
+}
+
+// Range 依次对每个条目调用fn，fn返回false时停止；逐个分片拷贝后在锁外调用，fn中可以安全地调用Add或Remove
+// Range calls fn for every entry until fn returns false; each shard is copied and fn runs outside the lock, so fn may safely call Add or Remove
+func (r *Registry[V]) Range(fn func(id int, value V) bool) {
+	type entry struct {
+		id    int
+		value V
+	}
+	var entries []entry
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		entries = entries[:0]
+		for id, value := range shard.items {
+			entries = append(entries, entry{id, value})
+		}
+		shard.mu.RUnlock()
+		for _, e := range entries {
+			if !fn(e.id, e.value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestRegistryConcurrentAccess 并发执行Add、Remove、Get和Range，需配合-race运行
+// TestRegistryConcurrentAccess runs Add, Remove, Get and Range concurrently, meant to run with -race
+func TestRegistryConcurrentAccess(t *testing.T) {
+	registry := NewRegistry[int](RegistryShards)
+	const workers, ids = 8, 500
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for id := w; id < ids; id += workers {
+				registry.Add(id, id)
+				if value, ok := registry.Get(id); !ok || value != id {
+					t.Errorf("Get(%d) = %d, %v after Add", id, value, ok)
+				}
+				if id%2 == 1 {
+					registry.Remove(id)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				registry.Range(func(id int, value int) bool {
+					if id != value {
+						t.Errorf("Range saw %d for id %d", value, id)
+					}
+					// 回调在锁外执行，可以安全地修改注册表
+					// The callback runs outside the lock, so it may modify the registry
+					registry.Get(id)
+					return true
+				})
+				registry.Len()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := registry.Len(); got != ids/2 {
+		t.Fatalf("Len() = %d, want %d", got, ids/2)
+	}
+	registry.Range(func(id int, _ int) bool {
+		if id%2 == 1 {
+			t.Errorf("removed id %d still present", id)
+		}
+		return true
+	})
+}
+
+// TestRegistryRangeStop Range在回调返回false时停止
+// TestRegistryRangeStop checks Range stops once the callback returns false
+func TestRegistryRangeStop(t *testing.T) {
+	registry := NewRegistry[int](4)
+	for id := 0; id < 100; id++ {
+		registry.Add(id, id)
+	}
+	visited := 0
+	registry.Range(func(int, int) bool {
+		visited++
+		return visited < 10
+	})
+	if visited != 10 {
+		t.Fatalf("Range visited %d entries after stopping, want 10", visited)
+	}
+}
+
+// TestRegistryCompareAndRemove 旧连接退出时不能移除同一ID下新登记的值
+// TestRegistryCompareAndRemove checks a departing connection cannot remove a newer value registered under the same ID
+func TestRegistryCompareAndRemove(t *testing.T) {
+	registry := NewRegistry[*int](4)
+	old, current := new(int), new(int)
+	registry.Add(1, old)
+	registry.Add(1, current)
+	if registry.CompareAndRemove(1, old) {
+		t.Fatal("CompareAndRemove removed a value that was replaced")
+	}
+	if value, ok := registry.Get(1); !ok || value != current {
+		t.Fatalf("Get(1) = %p, %v, want the current value %p", value, ok, current)
+	}
+	if !registry.CompareAndRemove(1, current) {
+		t.Fatal("CompareAndRemove kept the current value")
+	}
+	if _, ok := registry.Get(1); ok {
+		t.Fatal("value still present after CompareAndRemove")
+	}
+	if registry.CompareAndRemove(1, current) {
+		t.Fatal("CompareAndRemove reported removing an absent value")
+	}
+}
@@ -0,0 +1,306 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrSessionClosed 会话已关闭，消息不会再被发送
+// ErrSessionClosed means the session is closed and the message will not be sent
+var ErrSessionClosed = errors.New("session: closed")
+
+// ErrSendQueueFull 发送队列已满，消息按drop_newest策略被丢弃
+// ErrSendQueueFull means the send queue is full and the message was dropped by the drop_newest policy
+var ErrSendQueueFull = errors.New("session: send queue full")
+
+// OverflowPolicy 发送队列已满时的处理策略
+// OverflowPolicy decides what happens when a send queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest 丢弃队列中最早的消息，为新消息腾出位置
+	// OverflowDropOldest drops the oldest queued message to make room for the new one
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDropNewest 丢弃新消息并返回ErrSendQueueFull
+	// OverflowDropNewest drops the new message and returns ErrSendQueueFull
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	// OverflowDisconnect 以CloseTryAgainLater(1013)断开慢速客户端
+	// OverflowDisconnect disconnects the slow client with CloseTryAgainLater (1013)
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+// SendQueueSize 每个会话发送队列的容量
+// SendQueueSize is the capacity of each session's send queue
+var SendQueueSize = 256
+
+// SendOverflow 发送队列已满时的处理策略
+// SendOverflow is the policy applied when a send queue is full
+var SendOverflow = OverflowDropNewest
+
+// PingInterval 服务端发送ping的间隔
+// PingInterval is how often the server sends a ping
+var PingInterval = 30 * time.Second
+
+// IdleTimeout 超过该时长未收到客户端的任何消息或pong即判定连接已失效并关闭会话，必须大于PingInterval
+// IdleTimeout is how long a connection may go without any message or pong from the client before it is considered dead and the session is closed; it must exceed PingInterval
+var IdleTimeout = 75 * time.Second
+
+// WriteTimeout 单次写操作的最长时间，超时视为写失败
+// WriteTimeout is the longest a single write may take before it counts as failed
+var WriteTimeout = 10 * time.Second
+
+// MaxFrameSize 客户端单帧的最大字节数，超过时以1009关闭连接
+// MaxFrameSize is the maximum size in bytes of one client frame, larger frames close the connection with 1009
+var MaxFrameSize int64 = 4096
+
+// SessionMetrics 当前节点所有会话的累计计数
+// SessionMetrics holds the cumulative counters of every session on the current node
+var SessionMetrics struct {
+	// Dropped 因发送队列已满而丢弃的消息数 / Dropped counts messages dropped because a send queue was full
+	Dropped atomic.Int64
+	// SlowDisconnects 因发送队列已满而断开的慢速客户端数 / SlowDisconnects counts slow clients disconnected because their send queue was full
+	SlowDisconnects atomic.Int64
+	// IdleTimeouts 因超时未收到消息或pong而关闭的会话数 / IdleTimeouts counts sessions closed because no message or pong arrived in time
+	IdleTimeouts atomic.Int64
+}
+
+// closeWriteTimeout 发送关闭帧的最长等待时间
+// closeWriteTimeout is the longest time spent writing the close frame
+const closeWriteTimeout = time.Second
+
+// SessionState 会话状态：Open -> Closing -> Closed，只能向前转换
+// SessionState is the session state: Open -> Closing -> Closed, transitions only move forward
+type SessionState int32
+
+const (
+	// SessionOpen 正常收发 / SessionOpen sends and receives normally
+	SessionOpen SessionState = iota
+	// SessionClosing 已请求关闭：不再接受新消息，写协程正在发送关闭帧
+	// SessionClosing means close was requested: no new messages are accepted and the writer is sending the close frame
+	SessionClosing
+	// SessionClosed 写协程已退出，底层连接已关闭
+	// SessionClosed means the writer has exited and the underlying connection is closed
+	SessionClosed
+)
+
+// outbound 发送队列中的一条消息，prepared不为nil时直接写出预编码的帧
+// outbound is one message on the send queue; when prepared is set, the pre-encoded frame is written as is
+type outbound struct {
+	data     []byte
+	prepared *websocket.PreparedMessage
+}
+
+// Session 一个用户的WebSocket会话；所有写操作都经由唯一的写协程完成，满足gorilla/websocket单写者的要求
+// Session is one user's WebSocket session; every write goes through its single writer goroutine, satisfying gorilla/websocket's one-writer rule
+type Session struct {
+	// ID 用户ID / ID is the user ID
+	ID int
+	// Conn WebSocket连接，只允许读协程调用其读方法 / Conn is the WebSocket connection, only the reader may call its read methods
+	Conn *websocket.Conn
+	// Version 本连接协商的协议版本，登记到注册表前设置 / Version is the protocol version negotiated on this connection, set before the session is registered
+	Version int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// send 有界发送队列，由sendMu串行化入队以实现溢出策略
+	// send is the bounded send queue, enqueues are serialized by sendMu to apply the overflow policy
+	send     chan outbound
+	sendMu   sync.Mutex
+	overflow OverflowPolicy
+	state    atomic.Int32
+	done     chan struct{}
+
+	// closeOnce 保证只记录第一次关闭的原因 / closeOnce makes sure only the first close reason is recorded
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+	err       error
+}
+
+// NewSession 创建会话并启动写协程，发送队列容量和溢出策略取自SendQueueSize和SendOverflow，parent取消时会话随之关闭
+// NewSession creates a session and starts its writer goroutine, taking the send queue size and overflow policy from SendQueueSize and SendOverflow; the session closes when parent is cancelled
+func NewSession(parent context.Context, id int, conn *websocket.Conn) *Session {
+	ctx, cancel := context.WithCancel(parent)
+	s := &Session{
+		ID:        id,
+		Conn:      conn,
+		ctx:       ctx,
+		cancel:    cancel,
+		send:      make(chan outbound, SendQueueSize),
+		overflow:  SendOverflow,
+		done:      make(chan struct{}),
+		closeCode: websocket.CloseGoingAway,
+	}
+	// 超过帧大小限制时gorilla/websocket会发送1009关闭帧并使读取失败
+	// gorilla/websocket sends a 1009 close frame and fails the read when a frame exceeds the limit
+	conn.SetReadLimit(MaxFrameSize)
+	// 读超时由收到的消息和pong刷新，半开的连接会在IdleTimeout后读取失败
+	// The read deadline is refreshed by incoming messages and pongs, so a half-open connection fails to read after IdleTimeout
+	conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+	})
+	go s.writer()
+	return s
+}
+
+// ReadMessage 读取客户端的下一条消息并刷新读超时，只能由读协程调用；超时未收到消息或pong时计入IdleTimeouts
+// ReadMessage reads the client's next message and refreshes the read deadline, only the reader may call it; a timeout without message or pong counts towards IdleTimeouts
+func (s *Session) ReadMessage() (int, []byte, error) {
+	messageType, data, err := s.Conn.ReadMessage()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			SessionMetrics.IdleTimeouts.Add(1)
+		}
+		return messageType, data, err
+	}
+	return messageType, data, s.Conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+}
+
+// Context 会话的上下文，会话开始关闭时取消
+// Context is the session's context, cancelled once the session starts closing
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Done 写协程退出且连接关闭后关闭的通道
+// Done is closed once the writer has exited and the connection is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// State 当前会话状态 / State is the current session state
+func (s *Session) State() SessionState {
+	return SessionState(s.state.Load())
+}
+
+// Err 导致会话关闭的写错误，主动关闭时为nil
+// Err is the write error that closed the session, nil when it was closed on purpose
+func (s *Session) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Send 将一条文本消息放入发送队列，从不阻塞；队列已满时按溢出策略处理，会话关闭后返回ErrSessionClosed，不会panic
+// Send puts a text message on the send queue and never blocks; a full queue is handled by the overflow policy, and after close it returns ErrSessionClosed and never panics
+func (s *Session) Send(data []byte) error {
+	return s.enqueue(outbound{data: data})
+}
+
+// SendPrepared 与Send相同，但写出预编码的帧；同一条群聊消息只编码一次，由所有会话共用
+// SendPrepared is Send for a pre-encoded frame; a group message is encoded once and shared by every session
+func (s *Session) SendPrepared(message *websocket.PreparedMessage) error {
+	return s.enqueue(outbound{prepared: message})
+}
+
+// enqueue 按溢出策略将消息放入发送队列 / enqueue puts a message on the send queue according to the overflow policy
+func (s *Session) enqueue(message outbound) error {
+	// 发送通道从不关闭，关闭状态由ctx表示，因此并发的Send不会向已关闭的通道写入
+	// The send channel is never closed, the closed state is carried by ctx, so concurrent Sends can never write to a closed channel
+	if s.ctx.Err() != nil {
+		return ErrSessionClosed
+	}
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	select {
+	case s.send <- message:
+		return nil
+	default:
+	}
+
+	switch s.overflow {
+	case OverflowDropOldest:
+		// 写协程可能同时取走消息：腾出位置后新消息入队，丢弃的是最早的消息；仍放不下时丢弃新消息并返回ErrSendQueueFull
+		// The writer may take a message meanwhile: once there is room the new message is queued and the oldest one is what got dropped; if it still does not fit the new message is dropped and ErrSendQueueFull returned
+		// 每次入队只计一条丢弃
+		// Each enqueue counts at most one drop
+		select {
+		case <-s.send:
+		default:
+		}
+		SessionMetrics.Dropped.Add(1)
+		select {
+		case s.send <- message:
+			return nil
+		default:
+			return ErrSendQueueFull
+		}
+	case OverflowDisconnect:
+		SessionMetrics.SlowDisconnects.Add(1)
+		s.Close(websocket.CloseTryAgainLater, "slow consumer")
+		return ErrSessionClosed
+	default:
+		SessionMetrics.Dropped.Add(1)
+		return ErrSendQueueFull
+	}
+}
+
+// Close 请求以指定关闭码关闭会话，可重复调用，只有第一次生效；不等待关闭完成
+// Close requests the session to close with the given close code; it may be called repeatedly and only the first call counts; it does not wait for the close to finish
+func (s *Session) Close(code int, text string) {
+	s.closeOnce.Do(func() {
+		s.closeCode = code
+		s.closeText = text
+		s.state.CompareAndSwap(int32(SessionOpen), int32(SessionClosing))
+		s.cancel()
+	})
+}
+
+// fail 写失败时关闭会话并记录错误 / fail closes the session on a write error and records the error
+func (s *Session) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		s.closeCode = websocket.CloseAbnormalClosure
+		s.state.CompareAndSwap(int32(SessionOpen), int32(SessionClosing))
+		s.cancel()
+	})
+}
+
+// writer 唯一的写协程：依次写出消息并定时发送ping，会话关闭时发送关闭帧并关闭连接
+// writer is the only writer goroutine: it writes messages in order and sends periodic pings, and once the session closes, sends the close frame and closes the connection
+func (s *Session) writer() {
+	defer func() {
+		s.Conn.Close()
+		s.state.Store(int32(SessionClosed))
+		close(s.done)
+	}()
+	ping := time.NewTicker(PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ping.C:
+			if err := s.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WriteTimeout)); err != nil {
+				s.fail(err)
+				return
+			}
+		case message := <-s.send:
+			s.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			var err error
+			if message.prepared != nil {
+				err = s.Conn.WritePreparedMessage(message.prepared)
+			} else {
+				err = s.Conn.WriteMessage(websocket.TextMessage, message.data)
+			}
+			if err != nil {
+				s.fail(err)
+				return
+			}
+		case <-s.ctx.Done():
+			// 父上下文取消时也按正常关闭处理
+			// A cancelled parent context is treated as a regular close too
+			s.Close(websocket.CloseGoingAway, "")
+			if s.err == nil && s.closeCode != websocket.CloseAbnormalClosure {
+				message := websocket.FormatCloseMessage(s.closeCode, s.closeText)
+				s.Conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(closeWriteTimeout))
+			}
+			return
+		}
+	}
+}
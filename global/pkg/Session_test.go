@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestConn 通过本地HTTP服务建立一对WebSocket连接，返回服务端和客户端两端
+// newTestConn establishes a WebSocket pair through a local HTTP server, returning the server and client ends
+func newTestConn(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return <-accepted, client
+}
+
+// TestSessionConcurrentSendClose 多个协程并发Send时关闭会话，Send不会panic，关闭后只返回ErrSessionClosed
+// TestSessionConcurrentSendClose closes a session while many goroutines Send; Send never panics and only returns ErrSessionClosed after close
+func TestSessionConcurrentSendClose(t *testing.T) {
+	serverConn, client := newTestConn(t)
+	session := NewSession(context.Background(), 1, serverConn)
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 200; j++ {
+				err := session.Send([]byte("hello"))
+				if err != nil && !errors.Is(err, ErrSessionClosed) && !errors.Is(err, ErrSendQueueFull) {
+					t.Errorf("Send: unexpected error %v", err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			session.Close(websocket.CloseNormalClosure, "")
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not close")
+	}
+	if session.State() != SessionClosed {
+		t.Fatalf("State() = %d, want SessionClosed", session.State())
+	}
+	if err := session.Send([]byte("late")); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("Send after close = %v, want ErrSessionClosed", err)
+	}
+	if err := session.Err(); err != nil {
+		t.Fatalf("Err() = %v, want nil for a requested close", err)
+	}
+}
+
+// TestSessionSendOrder 同一协程发送的消息按顺序写出
+// TestSessionSendOrder checks messages sent by one goroutine are written in order
+func TestSessionSendOrder(t *testing.T) {
+	serverConn, client := newTestConn(t)
+	session := NewSession(context.Background(), 1, serverConn)
+	defer session.Close(websocket.CloseNormalClosure, "")
+	const count = 100
+	for i := 0; i < count; i++ {
+		if err := session.Send([]byte{byte(i)}); err != nil {
+			t.Fatalf("Send(%d): %v", i, err)
+		}
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < count; i++ {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if len(data) != 1 || int(data[0]) != i {
+			t.Fatalf("message %d = %v, want [%d]", i, data, i)
+		}
+	}
+}
+
+// TestSessionDropOldest drop_oldest策略下队列满时丢弃最早的消息、新消息入队，每次入队只计一条丢弃
+// TestSessionDropOldest checks that with drop_oldest a full queue drops its oldest message and takes the new one, counting one drop per enqueue
+func TestSessionDropOldest(t *testing.T) {
+	// 不启动写协程，队列内容保持不变 / No writer is started, so the queue contents stay put
+	s := &Session{ctx: context.Background(), send: make(chan outbound, 1), overflow: OverflowDropOldest}
+	before := SessionMetrics.Dropped.Load()
+	if err := s.enqueue(outbound{data: []byte("old")}); err != nil {
+		t.Fatalf("enqueue old: %v", err)
+	}
+	if err := s.enqueue(outbound{data: []byte("new")}); err != nil {
+		t.Fatalf("enqueue new: %v", err)
+	}
+	if dropped := SessionMetrics.Dropped.Load() - before; dropped != 1 {
+		t.Fatalf("Dropped grew by %d, want 1", dropped)
+	}
+	if queued := <-s.send; string(queued.data) != "new" {
+		t.Fatalf("queue holds %q, want new", queued.data)
+	}
+}
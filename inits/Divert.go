@@ -0,0 +1,71 @@
+package inits
+
+import (
+	"Gin/global/model"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// diverted 本地直投失败后改走消息代理、尚未处理完的单聊消息：消息ID到目标的映射以及每个目标的条数。
+// 目标存在这样的消息时，后续发给它的本地消息也必须走消息代理，在同一个投递通道中按顺序处理，才不会超过前面的消息
+// diverted tracks private messages that fell back to the broker after a failed local delivery and are not settled yet: message ID to target, plus a count per target.
+// While a target has such a message, later local messages to it must take the broker too, so they queue on the same delivery lane and none overtakes the earlier one
+var diverted = struct {
+	sync.Mutex
+	ids     map[string]int
+	targets map[int]int
+}{ids: make(map[string]int), targets: make(map[int]int)}
+
+// divertedCount 尚未处理完的改道消息总数，为0时投递工作协程无需解析消息 / divertedCount is the number of unsettled diverted messages, letting workers skip parsing while it is 0
+var divertedCount atomic.Int64
+
+// Divert 记录一条改走消息代理的本地单聊消息，在其处理完之前发往同一目标的消息都不能本地直投
+// Divert records a local private message that falls back to the broker; until it is settled no message to the same target may be delivered locally
+func Divert(Response model.Response) {
+	diverted.Lock()
+	defer diverted.Unlock()
+	if _, ok := diverted.ids[Response.Id]; ok {
+		return
+	}
+	diverted.ids[Response.Id] = Response.Target
+	diverted.targets[Response.Target]++
+	divertedCount.Add(1)
+}
+
+// SettleDiverted 改道消息已投递、转入死信队列或发布失败时取消记录，不是改道消息时什么也不做
+// SettleDiverted forgets a diverted message once it is delivered, dead-lettered or failed to publish; it does nothing for other messages
+func SettleDiverted(id string) {
+	diverted.Lock()
+	defer diverted.Unlock()
+	target, ok := diverted.ids[id]
+	if !ok {
+		return
+	}
+	delete(diverted.ids, id)
+	if diverted.targets[target]--; diverted.targets[target] <= 0 {
+		delete(diverted.targets, target)
+	}
+	divertedCount.Add(-1)
+}
+
+// Diverted 目标是否有改走消息代理、尚未处理完的消息
+// Diverted reports whether the target has a diverted message that is not settled yet
+func Diverted(target int) bool {
+	diverted.Lock()
+	defer diverted.Unlock()
+	return diverted.targets[target] > 0
+}
+
+// settleDelivery 投递工作协程处理完一条消息后调用，消息为改道消息时取消记录
+// settleDelivery is called by a delivery worker once a message is settled, forgetting it when it was diverted
+func settleDelivery(body []byte) {
+	if divertedCount.Load() == 0 {
+		return
+	}
+	var Response model.Response
+	if err := json.Unmarshal(body, &Response); err != nil || Response.Id == "" {
+		return
+	}
+	SettleDiverted(Response.Id)
+}
@@ -0,0 +1,160 @@
+package inits
+
+import (
+	"Gin/conf"
+	"Gin/global/model"
+	"Gin/global/pkg"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	// LoginBucketKey 可分配用户ID的列表
+	// LoginBucketKey is the list of assignable user IDs
+	LoginBucketKey = "LoginBucket"
+	// LoginBucketSize 可分配用户ID的数量，ID范围为1..LoginBucketSize
+	// LoginBucketSize is the number of assignable user IDs, IDs range over 1..LoginBucketSize
+	LoginBucketSize = 100
+	// DeadNodesKey 已判定下线、等待清理的节点集合
+	// DeadNodesKey is the set of nodes declared dead and waiting for cleanup
+	DeadNodesKey = "DeadNodes"
+	// JanitorLockKey 集群清理锁，保证同一时间只有一个节点执行清理
+	// JanitorLockKey is the cluster cleanup lock, making sure only one node cleans up at a time
+	JanitorLockKey = "JanitorLock"
+	// janitorLockTTL 清理锁的过期时间，持锁节点崩溃后锁自动释放
+	// janitorLockTTL is the cleanup lock expiry, released automatically when the holder crashes
+	janitorLockTTL = 30 * time.Second
+)
+
+// acquireIDScript 原子地从LoginBucket取出一个ID并连同本次连接的令牌记入节点集合（ID到令牌的哈希），避免取出后未记录导致ID泄漏
+// acquireIDScript atomically pops an ID from LoginBucket and records it with the connection's token in the node set (a hash from ID to token), so a popped ID can never go unrecorded
+var acquireIDScript = redis.NewScript(`
+local id = redis.call('RPOP', KEYS[1])
+if not id then
+	return false
+end
+redis.call('HSET', KEYS[2], id, ARGV[1])
+return id
+`)
+
+// releaseIDScript 原子地归还ID：仅当ID仍以取得它的连接的令牌记在节点集合中时才删除其路由映射并放回LoginBucket，
+// 保证只归还一次，且ID被归还后又分配给本节点的新连接时，旧连接不会把它归还
+// releaseIDScript atomically returns an ID: only while it is still recorded in the node set under the token of the connection that acquired it are its route mapping deleted and the ID pushed back,
+// so it is returned exactly once, and an old connection cannot return an ID that was returned and then handed to a new connection on this node
+var releaseIDScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[3] then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+if redis.call('GET', ARGV[1]) == ARGV[2] then
+	redis.call('DEL', ARGV[1])
+end
+redis.call('LPUSH', KEYS[2], ARGV[1])
+return 1
+`)
+
+// markDeadScript 原子地将节点移出心跳集合并加入待清理集合，只有移出成功的调用者返回1
+// markDeadScript atomically moves a node from the heartbeat set to the cleanup set, only the caller whose removal succeeds gets 1
+var markDeadScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('SADD', KEYS[2], ARGV[1])
+return 1
+`)
+
+// cleanNodeScript 原子地清理一个下线节点：删除其用户路由映射、归还ID、删除节点集合和节点元数据，并移出待清理集合；ARGV[2]为1时同时删除节点消息流
+// cleanNodeScript atomically cleans up a dead node: deletes its users' route mappings, returns the IDs, deletes the node set and node metadata, and leaves the cleanup set; the node stream is deleted too when ARGV[2] is 1
+var cleanNodeScript = redis.NewScript(`
+if redis.call('SISMEMBER', KEYS[3], ARGV[1]) == 0 then
+	return 0
+end
+-- 兼容旧版本以集合保存的节点集合 / Accept node sets saved as plain sets by older versions
+local ids
+if redis.call('TYPE', KEYS[1]).ok == 'set' then
+	ids = redis.call('SMEMBERS', KEYS[1])
+else
+	ids = redis.call('HKEYS', KEYS[1])
+end
+for _, id in ipairs(ids) do
+	if redis.call('GET', id) == ARGV[1] then
+		redis.call('DEL', id)
+	end
+	redis.call('LPUSH', KEYS[2], id)
+end
+redis.call('DEL', KEYS[1], KEYS[5])
+if ARGV[2] == '1' then
+	redis.call('DEL', KEYS[4])
+end
+redis.call('SREM', KEYS[3], ARGV[1])
+return #ids
+`)
+
+// releaseLockScript 仅当锁仍由自己持有时才释放
+// releaseLockScript releases the lock only while it is still held by the caller
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// AcquireUserID 从LoginBucket为当前节点的一个连接分配用户ID，返回ID和归还时使用的连接令牌
+// AcquireUserID allocates a user ID from LoginBucket for a connection on the current node, returning the ID and the connection token used to release it
+func AcquireUserID() (int, string, error) {
+	token := uuid.NewString()
+	id, err := acquireIDScript.Run(model.Ctx, model.RDB, []string{LoginBucketKey, model.OnlyMark}, token).Int()
+	return id, token, err
+}
+
+// ReleaseUserID 归还连接取得的用户ID并删除其路由映射；ID已被集群清理归还、又分配给新连接时什么也不做
+// ReleaseUserID returns the user ID acquired by a connection and deletes its route mapping; it does nothing once the ID was returned by the cluster cleanup and handed to a new connection
+func ReleaseUserID(id int, token string) {
+	err := releaseIDScript.Run(model.Ctx, model.RDB, []string{model.OnlyMark, LoginBucketKey}, strconv.Itoa(id), model.OnlyMark, token).Err()
+	if err != nil {
+		model.Logger.Error("Release user ID failed", zap.Int("id", id), zap.Error(err))
+	}
+}
+
+// CleanDeadNodes 持有集群清理锁时清理所有待清理的下线节点
+// CleanDeadNodes cleans up every dead node waiting for cleanup while holding the cluster cleanup lock
+func CleanDeadNodes() {
+	token := uuid.NewString()
+	locked, err := model.RDB.SetNX(model.Ctx, JanitorLockKey, token, janitorLockTTL).Result()
+	if err != nil || !locked {
+		return
+	}
+	defer releaseLockScript.Run(model.Ctx, model.RDB, []string{JanitorLockKey}, token)
+
+	nodes, err := model.RDB.SMembers(model.Ctx, DeadNodesKey).Result()
+	if err != nil {
+		model.Logger.Error("Get dead nodes failed", zap.Error(err))
+		return
+	}
+	// Redis Stream代理的节点使用固定标识，保留其消息流，节点重启后继续消费其中未确认的消息
+	// Redis stream broker nodes use fixed identifiers, so their streams are kept and the restarted node goes on consuming the unacknowledged entries
+	dropStream := conf.BrokerType != "redis"
+	for _, node := range nodes {
+		cleanNode(node, dropStream)
+	}
+}
+
+// cleanNode 清理一个已在待清理集合中的下线节点；dropStream为false时保留其消息流和消费者组，供以同一标识重启的节点继续消费未确认的消息
+// cleanNode cleans up one dead node that is already in the cleanup set; with dropStream false its stream and consumer group are kept, so a node restarting under the same identifier goes on consuming the unacknowledged entries
+func cleanNode(node string, dropStream bool) {
+	drop := "0"
+	if dropStream {
+		drop = "1"
+	}
+	released, err := cleanNodeScript.Run(model.Ctx, model.RDB,
+		[]string{node, LoginBucketKey, DeadNodesKey, pkg.StreamPrefix + node, NodeMetaPrefix + node}, node, drop).Int()
+	if err != nil {
+		model.Logger.Error("Clean dead node failed", zap.String("node", node), zap.Error(err))
+		return
+	}
+	model.Logger.Info("Dead node cleaned", zap.String("node", node), zap.Int("released ids", released))
+}
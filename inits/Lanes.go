@@ -0,0 +1,91 @@
+package inits
+
+import (
+	"Gin/global/model"
+	"Gin/global/pkg"
+	"encoding/json"
+	"sync"
+)
+
+// deliveryTargetBacklog 目标正在重试时最多为其积压的后续消息数，超过后新消息直接转入死信队列，慢速目标不会无限占用消息代理的未确认窗口
+// deliveryTargetBacklog is the most later messages held for a target while it is retrying; beyond that new messages are dead-lettered at once, so a slow target cannot tie up the broker's unacknowledged window
+var deliveryTargetBacklog = 8
+
+// laneKey 投递通道键：单聊和状态消息按目标用户ID排队，群聊消息使用独立的通道，不与任何用户共用
+// laneKey is the key of a delivery lane: private and status messages queue by target user ID, group messages use a lane of their own shared with no user
+type laneKey struct {
+	group  bool
+	target int
+}
+
+// deliveryLane 同一目标尚未处理完的消息，由一个协程按到达顺序逐条处理
+// deliveryLane holds the unsettled messages for one target, handled one by one in arrival order by a single goroutine
+type deliveryLane struct {
+	pending  []pkg.Delivery
+	retrying bool
+}
+
+// deliveryLanes 当前节点的所有投递通道：通道在有消息时创建并启动协程，消息处理完后删除；
+// 分发协程只向通道追加消息，从不等待某个目标，因此一个正在重试的目标不会耽误其他目标
+// deliveryLanes holds all delivery lanes of the node: a lane and its goroutine are created when a message arrives and removed once it is drained;
+// the dispatcher only appends to lanes and never waits for a target, so a retrying target never delays the others
+type deliveryLanes struct {
+	sync.Mutex
+	lanes map[laneKey]*deliveryLane
+}
+
+func newDeliveryLanes() *deliveryLanes {
+	return &deliveryLanes{lanes: make(map[laneKey]*deliveryLane)}
+}
+
+// laneOf 按消息类型和目标ID选择投递通道；无法解析的消息交给目标0的通道，由Dispatch返回解析错误
+// laneOf picks the delivery lane by message type and target ID; unparsable messages go to the lane of target 0, where Dispatch reports the parse error
+func laneOf(body []byte) laneKey {
+	var Response model.Response
+	if err := json.Unmarshal(body, &Response); err != nil {
+		return laneKey{}
+	}
+	return laneKey{group: Response.Type == "group", target: Response.Target}
+}
+
+// push 将消息追加到其目标的投递通道，通道空闲时启动处理协程；目标正在重试且积压已满时直接转入死信队列
+// push appends the message to its target's lane, starting the lane goroutine when the lane is idle; the message is dead-lettered at once when the target is retrying and its backlog is full
+func (l *deliveryLanes) push(delivery pkg.Delivery) {
+	key := laneOf(delivery.Body)
+	l.Lock()
+	lane, ok := l.lanes[key]
+	if ok && lane.retrying && len(lane.pending) >= deliveryTargetBacklog {
+		l.Unlock()
+		deadLetter(delivery, ErrTargetBacklogFull, 0)
+		return
+	}
+	if !ok {
+		lane = &deliveryLane{}
+		l.lanes[key] = lane
+		go l.run(key, lane)
+	}
+	lane.pending = append(lane.pending, delivery)
+	l.Unlock()
+}
+
+// run 按顺序处理通道中的消息，通道为空时删除通道并退出
+// run handles the lane's messages in order, removing the lane and returning once it is empty
+func (l *deliveryLanes) run(key laneKey, lane *deliveryLane) {
+	for {
+		l.Lock()
+		if len(lane.pending) == 0 {
+			delete(l.lanes, key)
+			l.Unlock()
+			return
+		}
+		delivery := lane.pending[0]
+		lane.pending[0] = pkg.Delivery{}
+		lane.pending = lane.pending[1:]
+		l.Unlock()
+		RabbitMqSumerRun(delivery, func(retrying bool) {
+			l.Lock()
+			lane.retrying = retrying
+			l.Unlock()
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package inits
+
+import (
+	"Gin/conf"
+	"Gin/global/model"
+	"Gin/global/pkg"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// NodeHeartbeatKey 节点心跳有序集合，成员为节点标识，分数为最近一次心跳时Redis服务器的毫秒时间戳
+// NodeHeartbeatKey is the node heartbeat sorted set, members are node marks and scores are the last heartbeat in unix milliseconds of the Redis server time
+const NodeHeartbeatKey = "NodeHeartbeats"
+
+// NodeMetaPrefix 节点元数据哈希的键前缀，完整键为 Node:<节点标识>
+// NodeMetaPrefix is the key prefix of the node metadata hash, the full key is Node:<node mark>
+const NodeMetaPrefix = "Node:"
+
+// NodeMeta 节点元数据，由节点每次心跳时刷新
+// NodeMeta is the node metadata, refreshed by the node on every heartbeat
+type NodeMeta struct {
+	// Node 节点标识 / Node is the node mark
+	Node string `json:"node"`
+	// Addr 节点公布的访问地址 / Addr is the address the node advertises
+	Addr string `json:"addr"`
+	// Version 服务版本 / Version is the service version
+	Version string `json:"version"`
+	// StartTime 节点启动时间 / StartTime is when the node started
+	StartTime time.Time `json:"start_time"`
+	// Connections 节点上的在线连接数 / Connections is the number of online connections on the node
+	Connections int64 `json:"connections"`
+	// Heartbeat 最近一次心跳时间 / Heartbeat is the time of the last heartbeat
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// startTime 当前节点的启动时间 / startTime is when the current node started
+var startTime = time.Now()
+
+// NodeEventChannel 节点上下线事件的Redis Pub/Sub频道
+// NodeEventChannel is the Redis Pub/Sub channel of node join and leave events
+const NodeEventChannel = "NodeEvents"
+
+// 节点事件类型 / Node event types
+const (
+	NodeEventJoin  = "join"
+	NodeEventLeave = "leave"
+)
+
+// NodeEvent 节点上下线事件
+// NodeEvent is a node join or leave event
+type NodeEvent struct {
+	Type string `json:"type"`
+	Node string `json:"node"`
+}
+
+// nodeEvents 节点事件订阅，节点退出时关闭 / nodeEvents is the node event subscription, closed when the node leaves
+var nodeEvents *redis.PubSub
+
+// heartbeatStop 通知心跳协程退出 / heartbeatStop tells the heartbeat goroutine to exit
+var heartbeatStop = make(chan struct{})
+
+// heartbeatDone 心跳协程已退出 / heartbeatDone is closed once the heartbeat goroutine has exited
+var heartbeatDone = make(chan struct{})
+
+// heartbeatOnce 保证只停止一次心跳 / heartbeatOnce makes sure heartbeats are stopped only once
+var heartbeatOnce sync.Once
+
+// NodeIdentity 确定当前节点标识：使用配置的固定标识，未配置时保留随机生成的UUID，并为日志附加节点标识
+// NodeIdentity settles the current node mark: the configured fixed identifier, or the randomly generated UUID when none is configured, and tags the logger with it
+func NodeIdentity() {
+	if conf.NodeID != "" {
+		model.OnlyMark = conf.NodeID
+	}
+	model.Logger = model.Logger.With(zap.String("node", model.OnlyMark))
+}
+
+// reclaimNode 固定标识的节点重启时接管上一次运行残留的数据；若该标识仍在被其他存活节点使用则终止程序
+// reclaimNode takes over what the previous run of a fixed-identity node left behind; the program terminates when another live node still uses the identifier
+func reclaimNode() {
+	last, err := model.RDB.ZScore(model.Ctx, NodeHeartbeatKey, model.OnlyMark).Result()
+	if err == nil {
+		// 上一次运行可能刚崩溃，等待其心跳超时；超时前心跳被刷新说明有另一个节点正在使用该标识；心跳是Redis时间，按Redis时间计算等待时长
+		// The previous run may have just crashed, so wait for its heartbeat to time out; a refreshed heartbeat means another node is using the identifier; heartbeats are Redis time, so the wait is computed against the Redis time
+		now, err := model.RDB.Time(model.Ctx).Result()
+		if err != nil {
+			model.Logger.Fatal("Read redis time failed", zap.Error(err))
+		}
+		expire := time.UnixMilli(int64(last)).Add(conf.NodeTTL)
+		if wait := expire.Sub(now); wait > 0 {
+			model.Logger.Warn("Node ID has a recent heartbeat, waiting for it to expire", zap.Duration("wait", wait))
+			time.Sleep(wait)
+		}
+		if current, err := model.RDB.ZScore(model.Ctx, NodeHeartbeatKey, model.OnlyMark).Result(); err == nil && current > last {
+			model.Logger.Fatal("Node ID is already in use by a live node", zap.String("Config Name", "NodeID"))
+		}
+	} else if err != redis.Nil {
+		model.Logger.Fatal("Read node heartbeat failed", zap.Error(err))
+	}
+	// 走下线节点的清理路径，归还上一次运行占用的用户ID和路由映射；消息流和消费者组保留，重启前未确认的消息由本次运行继续投递
+	// Take the dead node cleanup path to return the user IDs and route mappings held by the previous run; the stream and consumer group are kept so this run goes on delivering the entries left unacknowledged
+	model.RDB.ZRem(model.Ctx, NodeHeartbeatKey, model.OnlyMark)
+	model.RDB.SAdd(model.Ctx, DeadNodesKey, model.OnlyMark)
+	cleanNode(model.OnlyMark, false)
+}
+
+// NodeIntoGroup 将当前节点加入Redis中的存活节点集合（写入首次心跳和节点元数据）
+// NodeIntoGroup adds current node to the live node set in Redis (writes the first heartbeat and the node metadata)
+func NodeIntoGroup() {
+	if conf.NodeID != "" {
+		reclaimNode()
+	}
+	if err := beat(true); err != nil {
+		model.Logger.Error("Node heartbeat failed", zap.Error(err))
+	}
+	// 写入心跳后再通知其他节点，保证其同步时能读到当前节点
+	// Notify other nodes after the heartbeat is written so their sync can see the current node
+	PublishNodeEvent(NodeEventJoin, model.OnlyMark)
+	model.Logger.Info("Node into redis already") // 记录Redis连接成功日志
+}
+
+// PublishNodeEvent 广播一条节点上下线事件
+// PublishNodeEvent broadcasts a node join or leave event
+func PublishNodeEvent(kind string, node string) {
+	body, _ := json.Marshal(NodeEvent{Type: kind, Node: node})
+	if err := model.RDB.Publish(model.Ctx, NodeEventChannel, body).Err(); err != nil {
+		model.Logger.Error("Publish node event failed", zap.String("type", kind), zap.String("node", node), zap.Error(err))
+	}
+}
+
+// nodeEventsActive 节点事件订阅是否已生效，未生效时定时同步使用较短的兜底间隔
+// nodeEventsActive reports whether the node event subscription is in effect, periodic sync uses the shorter fallback interval while it is not
+var nodeEventsActive atomic.Bool
+
+// nodeEventRetryMax 重新订阅节点事件的最长等待时间 / nodeEventRetryMax is the longest wait between node event subscription attempts
+const nodeEventRetryMax = 30 * time.Second
+
+// NodeEventSubscribe 订阅节点上下线事件，收到事件后立即同步消息代理的节点连接；订阅失败时在后台重试
+// NodeEventSubscribe subscribes to node join and leave events and synchronizes the broker's node connections as soon as one arrives; a failed subscription is retried in the background
+func NodeEventSubscribe() {
+	nodeEvents = model.RDB.Subscribe(model.Ctx, NodeEventChannel)
+	// 等待订阅确认，保证之后的初始同步不会漏掉事件
+	// Wait for the subscription confirmation so that the following initial sync cannot miss an event
+	if _, err := nodeEvents.Receive(model.Ctx); err != nil {
+		model.Logger.Error("Subscribe node events failed, retrying in background", zap.Error(err))
+		go retryNodeEvents()
+		return
+	}
+	consumeNodeEvents()
+}
+
+// retryNodeEvents 按指数退避重新订阅节点事件，成功后立即同步一次以补上期间错过的事件；节点退出时停止
+// retryNodeEvents resubscribes to node events with exponential backoff and syncs once on success to catch up on missed events; it stops when the node leaves
+func retryNodeEvents() {
+	for delay := time.Second; ; delay = min(delay*2, nodeEventRetryMax) {
+		select {
+		case <-heartbeatStop:
+			return
+		case <-time.After(delay):
+		}
+		if _, err := nodeEvents.Receive(model.Ctx); err != nil {
+			model.Logger.Warn("Subscribe node events failed", zap.Duration("retry in", delay), zap.Error(err))
+			continue
+		}
+		model.Logger.Info("Node events subscribed")
+		consumeNodeEvents()
+		PullAndConnRabbieMq()
+		return
+	}
+}
+
+// consumeNodeEvents 启动处理节点事件的协程 / consumeNodeEvents starts the goroutine handling node events
+func consumeNodeEvents() {
+	nodeEventsActive.Store(true)
+	go func() {
+		defer nodeEventsActive.Store(false)
+		for message := range nodeEvents.Channel() {
+			var event NodeEvent
+			if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+				model.Logger.Error("Invalid node event", zap.String("payload", message.Payload), zap.Error(err))
+				continue
+			}
+			if event.Node == model.OnlyMark {
+				continue
+			}
+			model.Logger.Info("Node event received", zap.String("type", event.Type), zap.String("node", event.Node))
+			PullAndConnRabbieMq()
+		}
+	}()
+}
+
+// NodeHeartbeat 定时刷新当前节点的心跳，检查其他节点是否已超时下线并清理下线节点
+// NodeHeartbeat periodically refreshes the current node's heartbeat, checks whether other nodes have timed out and cleans up dead nodes
+func NodeHeartbeat() {
+	defer close(heartbeatDone)
+	ticker := time.NewTicker(conf.NodeHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := beat(false); errors.Is(err, ErrNodeReaped) {
+				rejoin()
+			} else if err != nil {
+				model.Logger.Error("Node heartbeat failed", zap.Error(err))
+			}
+			ReapDeadNodes()
+			CleanDeadNodes()
+		case <-heartbeatStop:
+			return
+		}
+	}
+}
+
+// ErrNodeReaped 当前节点仍在运行，但已被其他节点判定超时下线
+// ErrNodeReaped means the current node is still running but other nodes have declared it dead
+var ErrNodeReaped = errors.New("node was reaped")
+
+// redisNowScript 心跳相关脚本的开头：以Redis服务器时间（毫秒）作为now，所有节点写入和比较心跳都使用同一个时钟，不受节点之间时钟偏差影响
+// redisNowScript is the prologue of the heartbeat scripts: now is the Redis server time in milliseconds, so every node writes and compares heartbeats against one clock regardless of clock skew between nodes
+const redisNowScript = `
+redis.replicate_commands()
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+`
+
+// heartbeatScript 以Redis时间刷新心跳并返回该时间：非加入时只更新已存在的心跳，节点已被移出心跳集合时返回0而不是悄悄重新加入
+// heartbeatScript refreshes the heartbeat with the Redis time and returns it: unless joining it only updates an existing heartbeat, returning 0 instead of silently re-adding a node that was removed from the heartbeat set
+var heartbeatScript = redis.NewScript(redisNowScript + `
+if ARGV[2] ~= '1' and not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now, ARGV[1])
+return now
+`)
+
+// liveNodesScript 返回按Redis时间心跳未超过ARGV[1]毫秒的节点
+// liveNodesScript returns the nodes whose heartbeat is at most ARGV[1] milliseconds old by the Redis time
+var liveNodesScript = redis.NewScript(redisNowScript + `
+return redis.call('ZRANGEBYSCORE', KEYS[1], now - tonumber(ARGV[1]), '+inf')
+`)
+
+// reapScript 按Redis时间原子地将心跳超过ARGV[1]毫秒的节点移出心跳集合并加入待清理集合，返回被移出的节点
+// reapScript atomically moves the nodes whose heartbeat is more than ARGV[1] milliseconds old by the Redis time from the heartbeat set to the cleanup set, returning the moved nodes
+var reapScript = redis.NewScript(redisNowScript + `
+local stale = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. (now - tonumber(ARGV[1])))
+for _, node in ipairs(stale) do
+	redis.call('ZREM', KEYS[1], node)
+	redis.call('SADD', KEYS[2], node)
+end
+return stale
+`)
+
+// beat 写入一次当前节点的心跳，并刷新节点元数据（元数据被清理后也能完整恢复）；join为false且节点已被判定下线时返回ErrNodeReaped
+// beat writes one heartbeat of the current node and refreshes the node metadata (restoring it in full after a cleanup); it returns ErrNodeReaped when join is false and the node has been declared dead
+func beat(join bool) error {
+	connections, err := model.RDB.HLen(model.Ctx, model.OnlyMark).Result()
+	if err != nil {
+		return err
+	}
+	flag := "0"
+	if join {
+		flag = "1"
+	}
+	now, err := heartbeatScript.Run(model.Ctx, model.RDB, []string{NodeHeartbeatKey}, model.OnlyMark, flag).Int64()
+	if err != nil {
+		return err
+	}
+	if now == 0 {
+		return ErrNodeReaped
+	}
+	return model.RDB.HSet(model.Ctx, NodeMetaPrefix+model.OnlyMark,
+		"addr", conf.NodeAddr,
+		"version", conf.Version,
+		"start_time", startTime.UnixMilli(),
+		"connections", connections,
+		"heartbeat", now,
+	).Err()
+}
+
+// rejoin 当前节点被误判下线（如长时间GC停顿或Redis断线）后重新加入集群：其用户ID可能已归还并分配给其他用户，
+// 因此先完成对自身的清理（保留消息流），再关闭所有本地会话让客户端重新连接获取新ID，最后重新写入心跳并通知其他节点
+// rejoin brings the node back after it was wrongly declared dead (e.g. a long GC pause or a Redis outage): its user IDs may already have been returned and handed to other users,
+// so it first finishes its own cleanup (keeping the stream), then closes every local session so clients reconnect with fresh IDs, and finally writes the heartbeat again and notifies the other nodes
+func rejoin() {
+	model.Logger.Warn("Node was declared dead while alive, closing local sessions and rejoining")
+	// 仍在待清理集合中时由本节点完成清理，避免重新加入后新分配的ID被延迟执行的清理删除
+	// Finish the cleanup here while the node is still waiting in the cleanup set, so a late cleanup cannot delete IDs handed out after rejoining
+	cleanNode(model.OnlyMark, false)
+	// 用户ID已归还；会话在后台关闭，其ID可能已分配给本节点的新连接，ReleaseUserID和CompareAndRemove按连接核对，不会影响新连接
+	// The user IDs are already returned; the sessions close in the background and their IDs may already belong to new connections on this node, but ReleaseUserID and CompareAndRemove check the connection and leave the new ones alone
+	model.Sessions.Range(func(_ int, session *pkg.Session) bool {
+		session.Close(websocket.CloseServiceRestart, "node rejoining cluster")
+		return true
+	})
+	if err := beat(true); err != nil {
+		model.Logger.Error("Node rejoin heartbeat failed", zap.Error(err))
+		return
+	}
+	PublishNodeEvent(NodeEventJoin, model.OnlyMark)
+}
+
+// NodeInfo 读取指定节点的元数据，节点不存在时返回redis.Nil
+// NodeInfo reads the metadata of the given node, returning redis.Nil when the node does not exist
+func NodeInfo(node string) (NodeMeta, error) {
+	fields, err := model.RDB.HGetAll(model.Ctx, NodeMetaPrefix+node).Result()
+	if err != nil {
+		return NodeMeta{}, err
+	}
+	if len(fields) == 0 {
+		return NodeMeta{}, redis.Nil
+	}
+	millis := func(name string) time.Time {
+		value, _ := strconv.ParseInt(fields[name], 10, 64)
+		return time.UnixMilli(value)
+	}
+	connections, _ := strconv.ParseInt(fields["connections"], 10, 64)
+	return NodeMeta{
+		Node:        node,
+		Addr:        fields["addr"],
+		Version:     fields["version"],
+		StartTime:   millis("start_time"),
+		Connections: connections,
+		Heartbeat:   millis("heartbeat"),
+	}, nil
+}
+
+// LiveNodeInfos 返回所有存活节点的元数据
+// LiveNodeInfos returns the metadata of every live node
+func LiveNodeInfos() ([]NodeMeta, error) {
+	nodes, err := LiveNodes()
+	if err != nil {
+		return nil, err
+	}
+	var infos []NodeMeta
+	for _, node := range nodes {
+		info, err := NodeInfo(node)
+		if err != nil {
+			if err != redis.Nil {
+				model.Logger.Error("Get node metadata failed", zap.String("node", node), zap.Error(err))
+			}
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// LiveNodes 返回心跳未超时的节点标识；读取失败时返回错误，调用方不能把它当作没有存活节点
+// LiveNodes returns the marks of nodes whose heartbeat has not timed out; a failed read returns the error, callers must not take it for an empty cluster
+func LiveNodes() ([]string, error) {
+	return liveNodesScript.Run(model.Ctx, model.RDB, []string{NodeHeartbeatKey}, conf.NodeTTL.Milliseconds()).StringSlice()
+}
+
+// ReapDeadNodes 将心跳超时的节点移出存活节点集合并加入待清理集合；移出成功的节点负责记录该节点下线
+// ReapDeadNodes moves nodes whose heartbeat timed out from the live node set to the cleanup set; the node whose removal succeeds reports the death
+func ReapDeadNodes() []string {
+	// 查找和移出在同一个脚本中完成，多个节点同时检查时每个节点只会被一个检查者移出，避免重复上报
+	// Finding and removing happen in one script, so when several nodes check at once each node is removed by one checker only, avoiding duplicate reports
+	dead, err := reapScript.Run(model.Ctx, model.RDB, []string{NodeHeartbeatKey, DeadNodesKey}, conf.NodeTTL.Milliseconds()).StringSlice()
+	if err != nil {
+		model.Logger.Error("Reap dead nodes failed", zap.Error(err))
+		return nil
+	}
+	for _, node := range dead {
+		model.Logger.Warn("Node declared dead", zap.String("node", node), zap.Duration("ttl", conf.NodeTTL))
+		PublishNodeEvent(NodeEventLeave, node)
+	}
+	return dead
+}
+
+// NodeLeave 停止心跳，将当前节点移出存活节点集合并清理其残留数据
+// NodeLeave stops heartbeats, removes the current node from the live node set and cleans up what it leaves behind
+func NodeLeave() {
+	heartbeatOnce.Do(func() {
+		close(heartbeatStop)
+	})
+	// 等待心跳协程退出，避免退出后又写入一次心跳
+	// Wait for the heartbeat goroutine to exit so that it cannot write another heartbeat afterwards
+	select {
+	case <-heartbeatDone:
+	case <-time.After(conf.NodeHeartbeatInterval):
+	}
+	// 与心跳超时走同一条清理路径，超时未关闭的连接所占用的ID也能被归还
+	// Take the same cleanup path as a heartbeat timeout, so IDs held by connections that failed to close in time are returned too
+	markDeadScript.Run(model.Ctx, model.RDB, []string{NodeHeartbeatKey, DeadNodesKey}, model.OnlyMark)
+	PublishNodeEvent(NodeEventLeave, model.OnlyMark)
+	if nodeEvents != nil {
+		nodeEvents.Close()
+	}
+	CleanDeadNodes()
+}
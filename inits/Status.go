@@ -0,0 +1,134 @@
+package inits
+
+import (
+	"Gin/conf"
+	"Gin/global/model"
+	"Gin/global/pkg"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// MessageKeyPrefix 单聊消息投递记录的键前缀，完整键为 Msg:<消息ID>，值为"发送方ID:接收方ID"
+// MessageKeyPrefix is the key prefix of private message delivery records, the full key is Msg:<message ID> and the value is "senderID:targetID"
+const MessageKeyPrefix = "Msg:"
+
+// ErrAckRejected 确认的消息不存在、已过期、已确认过或不是发给确认方的
+// ErrAckRejected means the acknowledged message is unknown, expired, already acknowledged or was not sent to the acknowledging user
+var ErrAckRejected = errors.New("ack rejected")
+
+// ackScript 仅当消息记录的接收方就是确认方时删除记录并返回发送方ID，保证只有真正的接收方能确认且只确认一次
+// ackScript deletes the record and returns the sender ID only when the recorded recipient is the acknowledging user, so only the real recipient can acknowledge, and only once
+var ackScript = redis.NewScript(`
+local record = redis.call('GET', KEYS[1])
+if not record then
+	return false
+end
+local sender, target = string.match(record, '^(%d+):(%d+)$')
+if target ~= ARGV[1] then
+	return false
+end
+redis.call('DEL', KEYS[1])
+return sender
+`)
+
+// RecordMessage 记录单聊消息的发送方和接收方，在AckTTL内接收方可据此确认
+// RecordMessage records the sender and recipient of a private message, letting the recipient acknowledge it within AckTTL
+func RecordMessage(Response model.Response) error {
+	return model.RDB.Set(model.Ctx, MessageKeyPrefix+Response.Id, fmt.Sprintf("%d:%d", Response.FormId, Response.Target), conf.AckTTL).Err()
+}
+
+// AckMessage 处理接收方对单聊消息的确认：校验确认方是记录中的接收方后，将DELIVERED状态送回记录中的发送方
+// AckMessage handles a recipient's acknowledgement of a private message: once the acknowledging user is verified as the recorded recipient, a DELIVERED status is routed back to the recorded sender
+func AckMessage(id string, acker int) error {
+	sender, err := ackScript.Run(model.Ctx, model.RDB, []string{MessageKeyPrefix + id}, strconv.Itoa(acker)).Int()
+	if errors.Is(err, redis.Nil) {
+		return ErrAckRejected
+	}
+	if err != nil {
+		return err
+	}
+	RouteStatus(model.Response{Status: model.StatusDelivered, Target: sender, FormId: acker, Id: id})
+	return nil
+}
+
+// PublishToNode 通过消息代理向指定节点投递消息，节点未知时重新同步节点连接后重试一次
+// PublishToNode delivers a message to the given node via the broker, resyncing node connections and retrying once when the node is unknown
+func PublishToNode(mark string, data []byte) error {
+	err := model.Broker.Publish(mark, data)
+	if errors.Is(err, pkg.ErrNodeUnknown) {
+		PullAndConnRabbieMq()
+		err = model.Broker.Publish(mark, data)
+	}
+	return err
+}
+
+// SendStatus 向发送方会话发送状态帧；v1连接不认识消息ID，不发送
+// SendStatus sends a status frame to the sender's session; v1 connections do not know message IDs and get nothing
+func SendStatus(session *pkg.Session, status model.Response) {
+	if session.Version < model.ProtocolV2 {
+		return
+	}
+	data, _ := json.Marshal(model.SystemResponse{
+		Type:    model.FrameStatus,
+		Code:    status.Status,
+		Id:      status.Id,
+		Target:  status.FormId,
+		ReplyTo: status.ClientId,
+		Time:    time.Now().UnixMilli(),
+		Version: model.ProtocolV2,
+	})
+	session.Send(data)
+}
+
+// RouteStatus 将状态消息送回原消息的发送方：status.Target为发送方ID，status.FormId为接收方ID；
+// 发送方在本节点时直接发送，否则经消息代理转发到其所在节点，发送方已离线时丢弃
+// RouteStatus routes a status message back to the original sender: status.Target is the sender ID and status.FormId the recipient ID;
+// it is sent directly when the sender is on this node, forwarded to the sender's node via the broker otherwise, and dropped when the sender is offline
+func RouteStatus(status model.Response) {
+	status.Type = "status"
+	if session, ok := model.Sessions.Get(status.Target); ok {
+		SendStatus(session, status)
+		return
+	}
+	mark, err := model.RDB.Get(model.Ctx, fmt.Sprintf("%d", status.Target)).Result()
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		model.Logger.Error("Status serialization failed", zap.Error(err))
+		return
+	}
+	if err := PublishToNode(mark, data); err != nil {
+		model.Logger.Error("Publish status failed", zap.String("node", mark), zap.String("id", status.Id), zap.Error(err))
+	}
+}
+
+// notifyFailed 单聊消息转入死信队列时告知其发送方投递失败
+// notifyFailed tells the sender that a private message failed once it is dead-lettered
+func notifyFailed(body []byte) {
+	var Response model.Response
+	if err := json.Unmarshal(body, &Response); err != nil || Response.Type != "once" || Response.Id == "" {
+		return
+	}
+	RouteStatus(StatusOf(Response, model.StatusFailed))
+}
+
+// StatusOf 生成原消息的状态消息：Target为原消息的发送方ID，FormId为原消息的目标
+// StatusOf builds the status message of an original message: Target is the original sender ID and FormId the original target
+func StatusOf(Response model.Response, status string) model.Response {
+	return model.Response{
+		Type:     "status",
+		Status:   status,
+		Target:   Response.FormId,
+		FormId:   Response.Target,
+		Id:       Response.Id,
+		ClientId: Response.ClientId,
+	}
+}
@@ -5,8 +5,13 @@ import (
 	"Gin/global/model"
 	"Gin/global/pkg"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
@@ -14,121 +19,336 @@ import (
 // Init 初始化程序所需的各种组件和资源
 // Init initializes various components and resources required by the program
 func Init() {
-	conf.ReadConf()   // 读取配置文件
-	ZapBuild()        // 初始化Zap日志
-	RedisConn()       // 连接Redis
-	RedisMakeBucket() // 初始化Redis中的LoginBucket
+	ZapBuild()           // 初始化Zap日志（配置读取失败时需要日志输出）
+	conf.ReadConf()      // 读取配置文件
+	NodeIdentity()       // 确定节点标识
+	RedisConn()          // 连接Redis
+	RedisMakeBucket()    // 初始化Redis中的LoginBucket
+	go NodeHeartbeat()   // 启动节点心跳协程
+	BrokerBuild()        // 初始化消息代理
+	FanoutBuild()        // 初始化集群广播
+	NodeEventSubscribe() // 订阅节点上下线事件（先订阅再同步，避免遗漏事件）
 	PullAndConnRabbieMq()
-	go TimingSynchronization() // 启动定时同步协程
-	RabbitMqSumerConn()        // 初始化RabbitMQ消费者连接
+	go TimingSynchronization() // 启动兜底定时同步协程
+	RabbitMqSumerConn()        // 初始化消费者和投递通道
+	FanoutSubscribe()          // 订阅集群广播
 }
 
-// RabbitMqSumerConn 初始化多个RabbitMQ消费者
-// RabbitMqSumerConn initializes multiple RabbitMQ consumers
-func RabbitMqSumerConn() {
-	// 启动10个消费者协程
-	// Start 10 consumer goroutines
-	for i := 0; i < 10; i++ {
-		go RabbitMqSumerRun()
+// BrokerBuild 根据配置创建消息代理实例
+// BrokerBuild creates the message broker instance according to the configuration
+func BrokerBuild() {
+	switch conf.BrokerType {
+	case "memory":
+		model.Broker = pkg.NewMemoryBroker(model.OnlyMark)
+	case "redis":
+		broker, err := pkg.NewRedisStreamBroker(model.RDB, model.OnlyMark)
+		if err != nil {
+			model.Logger.Fatal("Redis stream broker build failed", zap.Error(err))
+		}
+		model.Broker = broker
+	default:
+		if conf.RabbitMqMode == "exchange" {
+			model.Broker = pkg.NewRabbitMqExchangeBroker(model.OnlyMark)
+		} else {
+			model.Broker = pkg.NewRabbitMqBroker(model.OnlyMark)
+		}
 	}
+	model.Logger.Info("Broker build success", zap.String("type", conf.BrokerType))
 }
 
-// RabbitMqSumerRun 运行RabbitMQ消费者逻辑
-// RabbitMqSumerRun runs the RabbitMQ consumer logic
-func RabbitMqSumerRun() {
-	// 消费简单队列
-	// Consume simple queue
-	simple, err := model.RabbieMqPoll[model.OnlyMark].ConsumeSimple()
+// RabbitMqSumerConn 初始化当前节点的消费者：只建立一个消费者以保持队列中的消息顺序，再按目标放入各自的投递通道并行投递
+// RabbitMqSumerConn initializes the node's consumer: a single consumer keeps the queue order, and deliveries are put on a lane per target that deliver in parallel
+func RabbitMqSumerConn() {
+	// 消费当前节点的消息
+	// Consume messages of the current node
+	deliveries, err := model.Broker.Consume()
 	if err != nil {
 		// 记录消费队列错误
 		// Log error when consuming queue
-		model.Logger.Error("ConsumeSimple", zap.Error(err))
+		model.Logger.Error("Broker Consume", zap.Error(err))
 		return
 	}
+	lanes := newDeliveryLanes()
+	go func() {
+		for delivery := range deliveries {
+			lanes.push(delivery)
+		}
+	}()
+}
 
-	// 循环处理消息
-	// Loop to process messages
-	for delivery := range simple {
-		var Response model.Response
-		// 解析消息体
-		// Parse message body
-		json.Unmarshal(delivery.Body, &Response)
-
-		// 根据消息类型分发数据
-		// Distribute data according to message type
-		switch Response.Type {
-		case "group":
-			// 群发消息，发送给所有节点
-			// Group message, send to all nodes
-			for _, node := range model.ConnectionPool {
-				node.Data <- delivery.Body
-			}
-		case "once":
-			// 单发消息，发送给目标节点
-			// One-time message, send to target node
-			model.ConnectionPool[Response.Target].Data <- delivery.Body
+// ErrTargetUnavailable 目标用户不在本节点或暂时无法接收消息
+// ErrTargetUnavailable means the target user is not on this node or temporarily cannot receive messages
+var ErrTargetUnavailable = errors.New("target user unavailable")
+
+// ErrTargetBacklogFull 目标正在重试且积压的消息已达上限
+// ErrTargetBacklogFull means the target is retrying and its backlog is at the limit
+var ErrTargetBacklogFull = errors.New("target backlog full")
+
+// RabbitMqSumerRun 处理投递通道中的一条消息（手动确认），retrying在开始和结束重试时被调用
+// RabbitMqSumerRun handles one message of a delivery lane (manual acknowledgement), retrying is called when retries start and end
+func RabbitMqSumerRun(delivery pkg.Delivery, retrying func(bool)) {
+	// 投递成功才确认；目标暂时不可用时按指数退避在原处重试，同一目标的后续消息等待其结束，因此不会被后来者超过；超过重试次数转入死信队列
+	// Ack only after delivery; retry in place with exponential backoff while the target is temporarily unavailable, later messages to the target wait for it so nothing overtakes it; dead-letter once retries are exhausted
+	err := Dispatch(delivery.Body)
+	retries := 0
+	if errors.Is(err, ErrTargetUnavailable) && conf.DeliveryRetries > 0 {
+		retrying(true)
+		defer retrying(false)
+	}
+	for ; errors.Is(err, ErrTargetUnavailable) && retries < conf.DeliveryRetries; retries++ {
+		model.Logger.Warn("Dispatch retry", zap.Int("retries", retries), zap.Error(err))
+		time.Sleep(retryBackoff(retries))
+		err = Dispatch(delivery.Body)
+	}
+	if err != nil {
+		deadLetter(delivery, err, retries)
+		return
+	}
+	if err := delivery.Ack(); err != nil {
+		model.Logger.Error("Delivery acknowledgement failed", zap.Error(err))
+	}
+	settleDelivery(delivery.Body)
+}
+
+// deadLetter 将无法投递的消息转入死信队列，并告知单聊消息的发送方投递失败
+// deadLetter moves an undeliverable message to the dead-letter queue and tells the sender of a private message that it failed
+func deadLetter(delivery pkg.Delivery, err error, retries int) {
+	model.Logger.Error("Dispatch failed, dead-letter message", zap.Int("retries", retries), zap.Error(err))
+	if err := delivery.Reject(fmt.Sprintf("%s (after %d retries)", err, retries)); err != nil {
+		model.Logger.Error("Delivery acknowledgement failed", zap.Error(err))
+	}
+	notifyFailed(delivery.Body)
+	settleDelivery(delivery.Body)
+}
+
+// retryBackoff 第retries+1次重试前的等待时间：从DeliveryRetryBackoff开始每次翻倍，不超过DeliveryRetryMaxBackoff
+// retryBackoff is the wait before retry number retries+1: starting at DeliveryRetryBackoff and doubling each time, at most DeliveryRetryMaxBackoff
+func retryBackoff(retries int) time.Duration {
+	backoff := conf.DeliveryRetryBackoff
+	for i := 0; i < retries && backoff < conf.DeliveryRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, conf.DeliveryRetryMaxBackoff)
+}
+
+// Dispatch 将节点收到的消息分发给本节点上的用户连接
+// Dispatch distributes a message received by the node to the user connections on this node
+func Dispatch(body []byte) error {
+	var Response model.Response
+	// 解析消息体
+	// Parse message body
+	if err := json.Unmarshal(body, &Response); err != nil {
+		return err
+	}
+
+	// 根据消息类型分发数据
+	// Distribute data according to message type
+	switch Response.Type {
+	case "group":
+		// 群发消息，发送给本节点的所有会话
+		// Group message, send to every session on this node
+		return DispatchGroup(Response)
+	case "once":
+		// 单发消息，发送给目标节点；目标已离开或发送队列已满时返回ErrTargetUnavailable
+		// One-time message, send to target node; return ErrTargetUnavailable when the target left or its send queue is full
+		session, ok := model.Sessions.Get(Response.Target)
+		if !ok {
+			return ErrTargetUnavailable
+		}
+		return SendResponse(session, Response)
+	case "status":
+		// 投递状态，发送给本节点上的原消息发送方；发送方已离开时丢弃，不重试
+		// Delivery status, send to the original sender on this node; dropped without retrying when the sender left
+		if session, ok := model.Sessions.Get(Response.Target); ok {
+			SendStatus(session, Response)
 		}
 	}
+	return nil
 }
 
+// SendResponse 按会话协商的协议版本编码消息并放入其发送队列，失败时返回ErrTargetUnavailable
+// SendResponse encodes the message with the session's negotiated protocol version and queues it, returning ErrTargetUnavailable on failure
+func SendResponse(session *pkg.Session, Response model.Response) error {
+	data, err := Response.Encode(session.Version)
+	if err != nil {
+		return err
+	}
+	if err := session.Send(data); err != nil {
+		return fmt.Errorf("%w: %w", ErrTargetUnavailable, err)
+	}
+	return nil
+}
+
+// fanoutJob 交给扇出工作协程的一批会话 / fanoutJob is a batch of sessions handed to a fan-out worker
+type fanoutJob struct {
+	sessions []*pkg.Session
+	frames   preparedFrames
+	wg       *sync.WaitGroup
+}
+
+// preparedFrames 同一条消息按各协议版本预编码的帧 / preparedFrames holds one message pre-encoded for every protocol version
+type preparedFrames map[int]*websocket.PreparedMessage
+
+// fanoutJobs 扇出工作协程的任务通道 / fanoutJobs is the job channel of the fan-out workers
+var fanoutJobs = make(chan fanoutJob)
+
+// fanoutPoolOnce 保证扇出工作协程只启动一次 / fanoutPoolOnce makes sure the fan-out workers are started once
+var fanoutPoolOnce sync.Once
+
+// DispatchGroup 将群聊消息交给本节点的所有会话：帧只编码一次，入队从不阻塞，会话较多时由工作协程池并行处理
+// DispatchGroup hands a group message to every session on this node: the frame is encoded once, enqueuing never blocks, and large nodes are processed in parallel by a worker pool
+func DispatchGroup(Response model.Response) error {
+	frames := preparedFrames{}
+	for _, version := range []int{model.ProtocolV1, model.ProtocolV2} {
+		data, err := Response.Encode(version)
+		if err != nil {
+			return err
+		}
+		if frames[version], err = websocket.NewPreparedMessage(websocket.TextMessage, data); err != nil {
+			return err
+		}
+	}
+	var sessions []*pkg.Session
+	model.Sessions.Range(func(_ int, session *pkg.Session) bool {
+		sessions = append(sessions, session)
+		return true
+	})
+	if len(sessions) <= conf.FanoutChunkSize {
+		sendPrepared(sessions, frames)
+		return nil
+	}
+
+	fanoutPoolOnce.Do(func() {
+		for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+			go func() {
+				for job := range fanoutJobs {
+					sendPrepared(job.sessions, job.frames)
+					job.wg.Done()
+				}
+			}()
+		}
+	})
+	// 等待所有批次入队完成后再返回，保证同一消费者投递的群聊消息在每个会话中保持顺序
+	// Wait for every batch to be enqueued before returning, so group messages from one consumer keep their order in every session
+	var wg sync.WaitGroup
+	for start := 0; start < len(sessions); start += conf.FanoutChunkSize {
+		end := min(start+conf.FanoutChunkSize, len(sessions))
+		wg.Add(1)
+		fanoutJobs <- fanoutJob{sessions: sessions[start:end], frames: frames, wg: &wg}
+	}
+	wg.Wait()
+	return nil
+}
+
+// sendPrepared 将对应协议版本的预编码帧放入每个会话的发送队列，已关闭或队列已满的会话按其溢出策略处理
+// sendPrepared puts the frame pre-encoded for each session's protocol version on its send queue, closed or full sessions are handled by their overflow policy
+func sendPrepared(sessions []*pkg.Session, frames preparedFrames) {
+	for _, session := range sessions {
+		if session.Version >= model.ProtocolV2 {
+			session.SendPrepared(frames[model.ProtocolV2])
+		} else {
+			session.SendPrepared(frames[model.ProtocolV1])
+		}
+	}
+}
+
+// FanoutBuild 根据配置创建集群广播实例，nodes模式下不创建
+// FanoutBuild creates the cluster broadcast instance according to the configuration, none in nodes mode
+func FanoutBuild() {
+	switch conf.GroupFanout {
+	case "redis":
+		model.Fanout = pkg.NewRedisFanout(model.RDB)
+	case "rabbitmq":
+		model.Fanout = pkg.NewRabbitMqFanout(model.OnlyMark)
+	default:
+		return
+	}
+	model.Logger.Info("Fanout build success", zap.String("mode", conf.GroupFanout))
+}
+
+// FanoutSubscribe 订阅集群广播并分发收到的群聊消息
+// FanoutSubscribe subscribes to the cluster broadcast and dispatches received group messages
+func FanoutSubscribe() {
+	if model.Fanout == nil {
+		return
+	}
+	broadcasts, err := model.Fanout.Subscribe()
+	if err != nil {
+		model.Logger.Fatal("Fanout Subscribe", zap.Error(err))
+	}
+	go func() {
+		for body := range broadcasts {
+			if err := Dispatch(body); err != nil {
+				model.Logger.Error("Dispatch broadcast failed", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// nodeSyncFallback 节点事件订阅未生效时定时同步的最长间隔，与引入节点事件前的轮询间隔相同
+// nodeSyncFallback is the longest periodic sync interval while the node event subscription is not in effect, the polling interval used before node events existed
+const nodeSyncFallback = time.Minute
+
 // TimingSynchronization 定时同步节点和RabbitMQ连接
 // TimingSynchronization periodically synchronizes nodes and RabbitMQ connections
 func TimingSynchronization() {
-	// 初始同步一次
-	// Initial synchronization
-	// 创建定时器，每60秒同步一次
-	// Create ticker, synchronize every 60 seconds
-	ticker := time.Ticker{C: time.Tick(time.Second * 60)}
-	for _ = range ticker.C {
+	// 节点变化通过事件实时同步，定时同步只用于修正遗漏的事件（如Redis断线期间）；订阅未生效时退回到原来的轮询间隔
+	// Node changes are synchronized by events, the timer only reconciles missed events (e.g. while Redis was disconnected); without an active subscription it falls back to the old polling interval
+	for {
+		interval := conf.NodeSyncInterval
+		if !nodeEventsActive.Load() {
+			interval = min(interval, nodeSyncFallback)
+		}
+		time.Sleep(interval)
 		PullAndConnRabbieMq()
 	}
 }
 
-// PullAndConnRabbieMq 拉取节点列表并同步RabbitMQ连接
-// PullAndConnRabbieMq pulls node list and synchronizes RabbitMQ connections
+// resync 合并并发的节点同步请求（定时器、节点事件和发送消息时的未知节点都会触发同步）
+// resync coalesces concurrent node sync requests (triggered by the ticker, node events and sends to unknown nodes)
+var resync pkg.Coalescer
+
+// PullAndConnRabbieMq 拉取节点列表并同步消息代理的节点连接；并发调用合并为一次同步，返回时已完成一次在调用之后开始的同步
+// PullAndConnRabbieMq pulls node list and synchronizes the broker's node connections; concurrent calls are merged into one sync, and it returns once a sync started after the call has finished
 func PullAndConnRabbieMq() {
-	// 从Redis获取所有节点标识
-	// Get all node identifiers from Redis
-	OrderOnlyMark := model.RDB.HGetAll(model.Ctx, "Nodes").Val()
-	ConnectedNodes := make(map[string]bool)
-	// 为每个节点建立RabbitMQ连接（如果不存在）
-	// Establish RabbitMQ connection for each node (if not exists)
-	for s, _ := range OrderOnlyMark {
-		_, ok := model.RabbieMqPoll[s]
-		if !ok {
-			Conn := pkg.NewRabbitMQSimple(s)
-			model.Logger.Info("RabbieMq Conn", zap.String("node", s))
-			model.RabbieMqPoll[s] = Conn
-		}
-		ConnectedNodes[s] = true
-	}
-	model.Logger.Info("Update RabbieMq Conn Already")
-	// 移除已不存在的节点连接
-	// Remove connections for non-existent nodes
-	for s, _ := range model.RabbieMqPoll {
-		if !ConnectedNodes[s] {
-			model.RabbieMqPoll[s].Destory()
-			delete(model.RabbieMqPoll, s)
-		}
+	// 不需要感知节点列表的代理（如内存代理）直接跳过
+	// Skip brokers that do not need the node list (e.g. the in-memory broker)
+	syncer, ok := model.Broker.(pkg.NodeSyncer)
+	if !ok {
+		return
 	}
+	resync.Do(func() {
+		syncNodes(syncer)
+	})
 }
 
-// NodeIntoGroup 将当前节点加入Redis中的节点分组
-// NodeIntoGroup adds current node to node group in Redis
-func NodeIntoGroup() {
-	model.RDB.HSet(model.Ctx, "Nodes", model.OnlyMark, "ok")
-	model.Logger.Info("Node into redis already") // 记录Redis连接成功日志
+// syncNodes 执行一次节点同步
+// syncNodes runs one node sync
+func syncNodes(syncer pkg.NodeSyncer) {
+	// 从Redis获取所有存活节点标识
+	// Get all live node identifiers from Redis
+	// 读取失败时保留现有连接，不能按空列表同步而断开所有节点
+	// Keep the current connections when the read fails instead of syncing an empty list and dropping every node
+	nodes, err := LiveNodes()
+	if err != nil {
+		model.Logger.Error("Get live nodes failed", zap.Error(err))
+		return
+	}
+	// 为每个节点建立连接（如果不存在），并移除已不存在的节点连接
+	// Establish connection for each node (if not exists) and remove connections for non-existent nodes
+	syncer.Sync(nodes)
+	model.Logger.Info("Update RabbieMq Conn Already", zap.Strings("nodes", nodes))
 }
 
 // RedisMakeBucket 初始化Redis中的LoginBucket，填充10000个元素
 // RedisMakeBucket initializes LoginBucket in Redis with 10000 elements
 func RedisMakeBucket() {
-	ok := model.RDB.Exists(model.Ctx, "LoginBucket").Val()
+	ok := model.RDB.Exists(model.Ctx, LoginBucketKey).Val()
 	if ok == 1 {
 		return
 	}
-	for i := 0; i < 100; i++ {
-		if err := model.RDB.LPush(model.Ctx, "LoginBucket", i+1).Err(); err != nil {
+	for i := 0; i < LoginBucketSize; i++ {
+		if err := model.RDB.LPush(model.Ctx, LoginBucketKey, i+1).Err(); err != nil {
 			// 记录Redis操作错误
 			// Log Redis operation error
 			model.Logger.Error("RedisMakeBucket", zap.Error(err))
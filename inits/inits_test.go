@@ -0,0 +1,438 @@
+package inits
+
+import (
+	"Gin/conf"
+	"Gin/global/model"
+	"Gin/global/pkg"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	model.Logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// newTestSession 建立一对WebSocket连接，将服务端会话以id登记到model.Sessions，返回会话和客户端连接
+// newTestSession establishes a WebSocket pair, registers the server session in model.Sessions under id, and returns the session and the client connection
+func newTestSession(t *testing.T, id int) (*pkg.Session, *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		accepted <- conn
+	}))
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatalf("dial: %v", err)
+	}
+	session := pkg.NewSession(context.Background(), id, <-accepted)
+	model.Sessions.Add(id, session)
+	t.Cleanup(func() {
+		model.Sessions.Remove(id)
+		session.Close(websocket.CloseNormalClosure, "")
+		client.Close()
+		server.Close()
+	})
+	return session, client
+}
+
+// useMemoryBroker 以内存代理作为当前节点的消息代理并启动投递工作协程，测试结束时关闭
+// useMemoryBroker installs an in-memory broker as the node's broker and starts the delivery workers, closing it when the test ends
+func useMemoryBroker(t *testing.T, mark string) *pkg.MemoryBroker {
+	t.Helper()
+	broker := pkg.NewMemoryBroker(mark)
+	model.Broker = broker
+	RabbitMqSumerConn()
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+// TestDeliveryOrderUnderLoad 多个发送方并发向同一目标发送，目标的发送队列很小以触发重试；每个发送方的消息必须按发送顺序到达且没有消息进入死信队列
+// TestDeliveryOrderUnderLoad has many senders write to one target concurrently with a tiny send queue to force retries; every sender's messages must arrive in send order and nothing may be dead-lettered
+func TestDeliveryOrderUnderLoad(t *testing.T) {
+	queueSize, retries, backoff, maxBackoff := pkg.SendQueueSize, conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff
+	pkg.SendQueueSize, conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff = 4, 1000, time.Millisecond, 5*time.Millisecond
+	const target, senders, perSender = 1, 8, 200
+	backlog := deliveryTargetBacklog
+	deliveryTargetBacklog = senders * perSender
+	defer func() {
+		pkg.SendQueueSize, conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff = queueSize, retries, backoff, maxBackoff
+		deliveryTargetBacklog = backlog
+	}()
+
+	broker := useMemoryBroker(t, "order-node")
+	_, client := newTestSession(t, target)
+
+	var wg sync.WaitGroup
+	for sender := 1; sender <= senders; sender++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			for seq := 0; seq < perSender; seq++ {
+				body, _ := json.Marshal(model.Response{Type: "once", Target: target, FormId: 100 + sender, Data: strconv.Itoa(seq)})
+				if err := broker.Publish("order-node", body); err != nil {
+					t.Errorf("Publish: %v", err)
+					return
+				}
+			}
+		}(sender)
+	}
+	// 客户端先不读取，让发送队列写满，迫使投递工作协程重试
+	// Hold off reading so the send queue fills up and the delivery worker has to retry
+	time.Sleep(50 * time.Millisecond)
+
+	next := make(map[int]int)
+	client.SetReadDeadline(time.Now().Add(20 * time.Second))
+	for received := 0; received < senders*perSender; received++ {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read after %d messages: %v", received, err)
+		}
+		var Response model.Response
+		if err := json.Unmarshal(data, &Response); err != nil {
+			t.Fatalf("unmarshal %q: %v", data, err)
+		}
+		seq, _ := strconv.Atoi(Response.Data)
+		if seq != next[Response.FormId] {
+			t.Fatalf("sender %d: got message %d, want %d", Response.FormId, seq, next[Response.FormId])
+		}
+		next[Response.FormId]++
+	}
+	wg.Wait()
+	if letters, _ := broker.DeadLetters(10); len(letters) != 0 {
+		t.Fatalf("%d messages dead-lettered, want none: %+v", len(letters), letters)
+	}
+}
+
+// TestDivertedUntilSettled 改道的消息被投递工作协程处理之前，目标一直处于改道状态
+// TestDivertedUntilSettled checks a target stays diverted until the delivery worker has settled the diverted message
+func TestDivertedUntilSettled(t *testing.T) {
+	broker := useMemoryBroker(t, "divert-node")
+	_, client := newTestSession(t, 2)
+
+	Response := model.Response{Type: "once", Target: 2, FormId: 3, Data: "first", Id: "divert-1"}
+	Divert(Response)
+	if !Diverted(2) {
+		t.Fatal("target not diverted after Divert")
+	}
+	body, _ := json.Marshal(Response)
+	if err := broker.Publish("divert-node", body); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := client.ReadMessage(); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for Diverted(2) {
+		if time.Now().After(deadline) {
+			t.Fatal("target still diverted after the message was delivered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestRetryBackoff 重试等待时间按指数增长并以最大值封顶
+// TestRetryBackoff checks the retry wait grows exponentially and is capped at the maximum
+func TestRetryBackoff(t *testing.T) {
+	backoff, maxBackoff := conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff
+	conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff = 100*time.Millisecond, time.Second
+	defer func() { conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff = backoff, maxBackoff }()
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for retries, expected := range want {
+		if got := retryBackoff(retries); got != expected {
+			t.Errorf("retryBackoff(%d) = %s, want %s", retries, got, expected)
+		}
+	}
+	if got := retryBackoff(100); got != time.Second {
+		t.Errorf("retryBackoff(100) = %s, want the 1s cap", got)
+	}
+}
+
+// readJSON 读取客户端收到的下一帧并解析到v，超时则测试失败
+// readJSON reads the next frame received by the client into v, failing the test on timeout
+func readJSON(t *testing.T, client *websocket.Conn, v any) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("unmarshal %q: %v", data, err)
+	}
+}
+
+// TestDispatch 单聊消息按接收方版本编码，目标不在本节点时返回ErrTargetUnavailable，群聊消息发给所有会话
+// TestDispatch checks private messages are encoded for the recipient's version, an absent target yields ErrTargetUnavailable, and group messages reach every session
+func TestDispatch(t *testing.T) {
+	v1, v1Client := newTestSession(t, 11)
+	v2, v2Client := newTestSession(t, 12)
+	v1.Version, v2.Version = model.ProtocolV1, model.ProtocolV2
+
+	body, _ := json.Marshal(model.Response{Type: "once", Target: 12, FormId: 11, Data: "hi", Id: "m-1"})
+	if err := Dispatch(body); err != nil {
+		t.Fatalf("Dispatch once: %v", err)
+	}
+	var received model.Response
+	readJSON(t, v2Client, &received)
+	if received.Data != "hi" || received.Id != "m-1" || received.Version != model.ProtocolV2 {
+		t.Fatalf("v2 recipient got %+v, want the v2 envelope", received)
+	}
+
+	body, _ = json.Marshal(model.Response{Type: "once", Target: 99, FormId: 11, Data: "nobody"})
+	if err := Dispatch(body); !errors.Is(err, ErrTargetUnavailable) {
+		t.Fatalf("Dispatch to absent target = %v, want ErrTargetUnavailable", err)
+	}
+
+	body, _ = json.Marshal(model.Response{Type: "group", Target: 0, FormId: 11, Data: "all", Id: "m-2"})
+	if err := Dispatch(body); err != nil {
+		t.Fatalf("Dispatch group: %v", err)
+	}
+	var raw map[string]any
+	readJSON(t, v1Client, &raw)
+	if raw["Data"] != "all" || raw["Id"] != nil {
+		t.Fatalf("v1 recipient got %v, want the v1 shape", raw)
+	}
+	readJSON(t, v2Client, &received)
+	if received.Data != "all" || received.Id != "m-2" {
+		t.Fatalf("v2 recipient got %+v, want the group message", received)
+	}
+
+	if err := Dispatch([]byte("not json")); err == nil {
+		t.Fatal("Dispatch of invalid JSON succeeded")
+	}
+}
+
+// TestPublishToNode 经内存代理发往集群中的另一个节点，节点未知时返回ErrNodeUnknown
+// TestPublishToNode publishes through the in-memory broker to another node of the cluster, returning ErrNodeUnknown for unknown nodes
+func TestPublishToNode(t *testing.T) {
+	broker := pkg.NewMemoryBroker("self")
+	other := broker.Join("other")
+	model.Broker = broker
+	defer broker.Close()
+
+	deliveries, err := other.Consume()
+	if err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	if err := PublishToNode("other", []byte("hello")); err != nil {
+		t.Fatalf("PublishToNode: %v", err)
+	}
+	select {
+	case delivery := <-deliveries:
+		if string(delivery.Body) != "hello" {
+			t.Fatalf("other node received %q, want %q", delivery.Body, "hello")
+		}
+		delivery.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("other node received nothing")
+	}
+	if err := PublishToNode("missing", []byte("lost")); !errors.Is(err, pkg.ErrNodeUnknown) {
+		t.Fatalf("PublishToNode to unknown node = %v, want ErrNodeUnknown", err)
+	}
+}
+
+// TestDeliveryDeadLetter 目标不在本节点的单聊消息重试耗尽后进入死信队列，并向v2发送方发送FAILED状态
+// TestDeliveryDeadLetter checks a private message whose target is absent is dead-lettered once retries run out and the v2 sender gets a FAILED status
+func TestDeliveryDeadLetter(t *testing.T) {
+	retries := conf.DeliveryRetries
+	conf.DeliveryRetries = 0
+	defer func() { conf.DeliveryRetries = retries }()
+
+	broker := useMemoryBroker(t, "dead-node")
+	sender, client := newTestSession(t, 21)
+	sender.Version = model.ProtocolV2
+
+	body, _ := json.Marshal(model.Response{Type: "once", Target: 22, FormId: 21, Data: "lost", Id: "m-3", ClientId: "c-3"})
+	if err := broker.Publish("dead-node", body); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	var status model.SystemResponse
+	readJSON(t, client, &status)
+	if status.Type != model.FrameStatus || status.Code != model.StatusFailed || status.Id != "m-3" || status.ReplyTo != "c-3" {
+		t.Fatalf("sender got %+v, want a FAILED status for m-3", status)
+	}
+	letters, err := broker.DeadLetters(10)
+	if err != nil {
+		t.Fatalf("DeadLetters: %v", err)
+	}
+	if len(letters) != 1 || letters[0].Body != string(body) {
+		t.Fatalf("DeadLetters = %+v, want the undeliverable message", letters)
+	}
+}
+
+// TestDispatchGroupWorkerPool 会话数超过分批大小时由工作协程池扇出，每个会话都按顺序收到所有群聊消息
+// TestDispatchGroupWorkerPool fans out on the worker pool when there are more sessions than the chunk size, and every session receives every group message in order
+func TestDispatchGroupWorkerPool(t *testing.T) {
+	chunkSize := conf.FanoutChunkSize
+	conf.FanoutChunkSize = 4
+	defer func() { conf.FanoutChunkSize = chunkSize }()
+
+	const sessions, messages = 21, 20
+	clients := make([]*websocket.Conn, 0, sessions)
+	for id := 1001; id < 1001+sessions; id++ {
+		session, client := newTestSession(t, id)
+		session.Version = model.ProtocolV1 + id%2
+		clients = append(clients, client)
+	}
+	for seq := 0; seq < messages; seq++ {
+		if err := DispatchGroup(model.Response{Type: "group", FormId: 1, Data: strconv.Itoa(seq), Id: "g-" + strconv.Itoa(seq)}); err != nil {
+			t.Fatalf("DispatchGroup %d: %v", seq, err)
+		}
+	}
+	for i, client := range clients {
+		for seq := 0; seq < messages; seq++ {
+			var received model.Response
+			readJSON(t, client, &received)
+			if received.Data != strconv.Itoa(seq) {
+				t.Fatalf("session %d: got message %q, want %d", i, received.Data, seq)
+			}
+		}
+	}
+}
+
+// TestSlowTargetDoesNotStallOthers 一个目标的发送队列已满、消息在原处重试时，其他目标的单聊和群聊消息仍然及时送达，客户端恢复读取后积压的消息按顺序送达
+// TestSlowTargetDoesNotStallOthers checks that while one target's send queue is full and its messages retry in place, private and group messages for other targets still arrive in time, and the backlog arrives in order once the client reads again
+func TestSlowTargetDoesNotStallOthers(t *testing.T) {
+	const slow, fast, count = 3, 4, 100
+	queueSize, retries, backoff, maxBackoff, backlog := pkg.SendQueueSize, conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff, deliveryTargetBacklog
+	pkg.SendQueueSize, conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff, deliveryTargetBacklog = 1, 100000, time.Millisecond, 10*time.Millisecond, count
+	defer func() {
+		pkg.SendQueueSize, conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff, deliveryTargetBacklog = queueSize, retries, backoff, maxBackoff, backlog
+	}()
+
+	broker := useMemoryBroker(t, "stall-node")
+	_, slowClient := newTestSession(t, slow)
+	_, fastClient := newTestSession(t, fast)
+	publish := func(Response model.Response) {
+		t.Helper()
+		body, _ := json.Marshal(Response)
+		if err := broker.Publish("stall-node", body); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	// 慢速客户端不读取，大消息很快写满套接字缓冲区和发送队列，之后的消息都在原处重试
+	// The slow client does not read, so large messages soon fill the socket buffers and the send queue and later messages retry in place
+	payload := strings.Repeat("x", 128<<10)
+	for seq := 0; seq < count; seq++ {
+		publish(model.Response{Type: "once", Target: slow, FormId: seq, Data: payload})
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	publish(model.Response{Type: "once", Target: fast, FormId: slow, Data: "private"})
+	publish(model.Response{Type: "group", Target: 0, FormId: slow, Data: "group"})
+	// 单聊和群聊消息在不同的投递通道中，到达顺序不固定
+	// Private and group messages travel on different lanes, so their arrival order is not fixed
+	fastClient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	received := make(map[string]bool)
+	for len(received) < 2 {
+		_, data, err := fastClient.ReadMessage()
+		if err != nil {
+			t.Fatalf("fast target stalled behind the slow one: %v", err)
+		}
+		var Response model.Response
+		if err := json.Unmarshal(data, &Response); err != nil || (Response.Data != "private" && Response.Data != "group") || received[Response.Data] {
+			t.Fatalf("fast target got unexpected %q", data)
+		}
+		received[Response.Data] = true
+	}
+
+	slowClient.SetReadDeadline(time.Now().Add(20 * time.Second))
+	for seq := 0; seq < count; {
+		_, data, err := slowClient.ReadMessage()
+		if err != nil {
+			t.Fatalf("slow target read after %d messages: %v", seq, err)
+		}
+		var Response model.Response
+		if err := json.Unmarshal(data, &Response); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if Response.Type == "group" {
+			continue
+		}
+		if Response.FormId != seq {
+			t.Fatalf("slow target got message %d, want %d", Response.FormId, seq)
+		}
+		seq++
+	}
+	if letters, _ := broker.DeadLetters(10); len(letters) != 0 {
+		t.Fatalf("%d messages dead-lettered, want none: %+v", len(letters), letters)
+	}
+}
+
+// TestTargetBacklogFull 目标正在重试时最多积压deliveryTargetBacklog条消息，之后的消息直接转入死信队列；目标上线后积压的消息按顺序送达
+// TestTargetBacklogFull checks a retrying target holds at most deliveryTargetBacklog later messages and further ones are dead-lettered at once; the backlog arrives in order once the target shows up
+func TestTargetBacklogFull(t *testing.T) {
+	retries, backoff, maxBackoff := conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff
+	conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff = 100000, time.Millisecond, time.Millisecond
+	defer func() {
+		conf.DeliveryRetries, conf.DeliveryRetryBackoff, conf.DeliveryRetryMaxBackoff = retries, backoff, maxBackoff
+	}()
+
+	const target = 5
+	broker := useMemoryBroker(t, "backlog-node")
+	publish := func(seq int) {
+		t.Helper()
+		body, _ := json.Marshal(model.Response{Type: "once", Target: target, FormId: seq, Data: "backlog"})
+		if err := broker.Publish("backlog-node", body); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	// 目标尚未上线，第一条消息在原处重试，之后的消息进入积压
+	// The target is not online yet, so the first message retries in place and later ones are held back
+	publish(0)
+	time.Sleep(50 * time.Millisecond)
+	for seq := 1; seq <= deliveryTargetBacklog+1; seq++ {
+		publish(seq)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		letters, _ := broker.DeadLetters(10)
+		if len(letters) == 1 {
+			var Response model.Response
+			json.Unmarshal([]byte(letters[0].Body), &Response)
+			if Response.FormId != deliveryTargetBacklog+1 || !strings.Contains(letters[0].Reason, ErrTargetBacklogFull.Error()) {
+				t.Fatalf("dead letter %+v, want message %d with reason %q", letters[0], deliveryTargetBacklog+1, ErrTargetBacklogFull)
+			}
+			break
+		}
+		if len(letters) > 1 || time.Now().After(deadline) {
+			t.Fatalf("%d messages dead-lettered, want only the one beyond the backlog", len(letters))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, client := newTestSession(t, target)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for seq := 0; seq <= deliveryTargetBacklog; seq++ {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read after %d messages: %v", seq, err)
+		}
+		var Response model.Response
+		if err := json.Unmarshal(data, &Response); err != nil || Response.FormId != seq {
+			t.Fatalf("got %q, want message %d", data, seq)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"Gin/api"
 	"Gin/global/model"
+	"Gin/global/pkg"
 	"Gin/inits"
 	"context"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
@@ -83,12 +85,13 @@ func main() {
 // Exit 函数用于程序退出前的清理操作
 // Exit function is used for cleanup operations before program exits
 func Exit() {
-	// 关闭用户连接
-	// Close user connections
+	// 关闭用户连接，并等待连接处理协程归还用户ID
+	// Close user connections and wait for the connection handlers to return their user IDs
 	CloseUserConn()
-	// 关闭RabbitMQ连接
-	// Close RabbitMQ connections
-	CloseRabbieMqConn()
+	WaitUserConn(5 * time.Second)
+	// 关闭消息代理连接
+	// Close broker connections
+	CloseBroker()
 	// 删除Redis中的数据
 	// Delete data in Redis
 	RedisDelete()
@@ -98,22 +101,39 @@ func Exit() {
 // RedisDelete 用于删除Redis中的特定数据
 // RedisDelete is used to delete specific data in Redis
 func RedisDelete() {
-	// 删除指定的Redis键
-	// Delete specified Redis key
-	model.RDB.Del(model.Ctx, model.OnlyMark)
-	// 删除哈希表中的指定字段
-	// Delete specified field in hash table
-	model.RDB.HDel(model.Ctx, "Nodes", model.OnlyMark)
+	// 停止心跳，将当前节点移出存活节点集合，并交由集群清理归还仍未释放的用户ID
+	// Stop heartbeats, remove the current node from the live node set and hand any user IDs still held to the cluster janitor
+	inits.NodeLeave()
 }
 
-// CloseRabbieMqConn 用于关闭所有RabbitMQ连接
-// CloseRabbieMqConn is used to close all RabbitMQ connections
-func CloseRabbieMqConn() {
-	// 遍历所有RabbitMQ连接并销毁
-	// Iterate through all RabbitMQ connections and destroy them
-	for s, mq := range model.RabbieMqPoll {
-		mq.Destory()
-		delete(model.RabbieMqPoll, s)
+// CloseBroker 用于关闭消息代理及其所有连接
+// CloseBroker is used to close the message broker and all its connections
+func CloseBroker() {
+	if model.Fanout != nil {
+		if err := model.Fanout.Close(); err != nil {
+			model.Logger.Error("Close fanout failed", zap.Error(err))
+		}
+	}
+	if model.Broker == nil {
+		return
+	}
+	if err := model.Broker.Close(); err != nil {
+		model.Logger.Error("Close broker failed", zap.Error(err))
+	}
+}
+
+// WaitUserConn 等待所有连接处理协程结束，最多等待timeout
+// WaitUserConn waits for every connection handler to finish, for at most timeout
+func WaitUserConn(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		model.ActiveConnWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		model.Logger.Warn("Timed out waiting for user connections to close")
 	}
 }
 
@@ -122,11 +142,8 @@ func CloseRabbieMqConn() {
 func CloseUserConn() {
 	// 向所有连接发送退出信号
 	// Send exit signal to all connections
-	for _, node := range model.ConnectionPool {
-		node.ExitFlag.Do(
-			func() {
-				node.Exit <- true
-			},
-		)
-	}
+	model.Sessions.Range(func(_ int, session *pkg.Session) bool {
+		session.Close(websocket.CloseGoingAway, "server shutting down")
+		return true
+	})
 }